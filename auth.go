@@ -0,0 +1,257 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// roles, each role can do everything the roles before it can
+type role int
+
+const (
+	roleViewer role = iota + 1
+	roleUploader
+	roleAdmin
+)
+
+const (
+	deviceCookie      = "device"
+	authCacheDuration = 10 * time.Minute
+)
+
+type contextKey string
+
+const identityContextKey = contextKey("identity")
+
+// identity is who made a request
+type identity struct {
+	name string
+	role role
+}
+
+type authUser struct {
+	passwordHash []byte
+	role         role
+}
+
+type authToken struct {
+	name  string
+	token string
+	role  role
+}
+
+// authenticator checks requests against the configured local users, API tokens and device tokens.
+// If none are configured, everyone is an admin
+type authenticator struct {
+	users   map[string]authUser
+	tokens  []authToken
+	devices []authToken
+
+	// bcrypt is deliberately slow, so successful logins are remembered for a while
+	cache sync.Map
+}
+
+func parseRole(name string) (role, error) {
+	switch name {
+	case "viewer":
+		return roleViewer, nil
+	case "uploader":
+		return roleUploader, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return 0, fmt.Errorf("Invalid role %s", name)
+}
+
+type authConfig struct {
+	Users []struct {
+		Username string `config:"username"`
+		Password secret `config:"password"`
+		Role     string `config:"role"`
+	} `config:"users"`
+	Tokens  []authTokenConfig `config:"tokens"`
+	Devices []authTokenConfig `config:"devices"`
+}
+
+type authTokenConfig struct {
+	Name  string `config:"name"`
+	Token secret `config:"token"`
+	Role  string `config:"role"`
+}
+
+func newAuthenticator() (*authenticator, error) {
+	a := &authenticator{users: make(map[string]authUser)}
+	config := newConfigSection("auth", viper.GetStringMap("auth"))
+	settings := authConfig{}
+	if err := config.check(&settings); err != nil {
+		return nil, err
+	}
+
+	var errs configErrors
+	for i, u := range settings.Users {
+		if u.Username == "" || u.Password == "" {
+			errs = append(errs, config.errorf(fmt.Sprintf("users[%d]", i), "username and password are required"))
+		}
+		r, err := configRole(config, fmt.Sprintf("users[%d]", i), u.Role)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		hash := []byte(string(u.Password))
+		if _, err := bcrypt.Cost(hash); u.Password != "" && err != nil {
+			errs = append(errs, config.errorf(fmt.Sprintf("users[%d].password", i),
+				"must be a bcrypt hash, i.e. from htpasswd -bnBC 10 \"\" password | tr -d ':\\n'"))
+		}
+		a.users[u.Username] = authUser{passwordHash: hash, role: r}
+	}
+
+	var err error
+	a.tokens, err = configTokens(config, "tokens", settings.Tokens)
+	errs = appendErrors(errs, err)
+	a.devices, err = configTokens(config, "devices", settings.Devices)
+	errs = appendErrors(errs, err)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return a, nil
+}
+
+// configRole parses the role of a user or token, which are viewers if it isn't set
+func configRole(config *configSection, key, name string) (role, error) {
+	if name == "" {
+		return roleViewer, nil
+	}
+	r, err := parseRole(name)
+	if err != nil {
+		return r, config.errorf(key+".role", "must be viewer, uploader or admin, not %q", name)
+	}
+	return r, nil
+}
+
+func configTokens(config *configSection, field string, entries []authTokenConfig) ([]authToken, error) {
+	var tokens []authToken
+	var errs configErrors
+	for i, t := range entries {
+		key := fmt.Sprintf("%s[%d]", field, i)
+		if t.Name == "" || t.Token == "" {
+			errs = append(errs, config.errorf(key, "name and token are required"))
+		}
+		r, err := configRole(config, key, t.Role)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		tokens = append(tokens, authToken{name: t.Name, token: string(t.Token), role: r})
+	}
+	return tokens, errs.err()
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.users) > 0 || len(a.tokens) > 0 || len(a.devices) > 0
+}
+
+func findToken(tokens []authToken, token string) *authToken {
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].token), []byte(token)) == 1 {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+// authenticate returns who made the request, or nil if they couldn't be identified.  Frames
+// authenticate once with their device token in the device query parameter, which is then kept in
+// a cookie
+func (a *authenticator) authenticate(w http.ResponseWriter, r *http.Request) *identity {
+	if !a.enabled() {
+		return &identity{name: "anonymous", role: roleAdmin}
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		if t := findToken(a.tokens, strings.TrimPrefix(header, "Bearer ")); t != nil {
+			return &identity{name: t.name, role: t.role}
+		}
+		return nil
+	}
+
+	// tokens in the query string allow links, like the upload QR code, to carry their own access
+	if token := r.URL.Query().Get("token"); token != "" {
+		if t := findToken(a.tokens, token); t != nil {
+			return &identity{name: t.name, role: t.role}
+		}
+		return nil
+	}
+
+	if device := r.URL.Query().Get("device"); device != "" {
+		if t := findToken(a.devices, device); t != nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     deviceCookie,
+				Value:    device,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				Expires:  time.Now().AddDate(10, 0, 0),
+			})
+			return &identity{name: t.name, role: t.role}
+		}
+		return nil
+	}
+
+	if cookie, err := r.Cookie(deviceCookie); err == nil {
+		if t := findToken(a.devices, cookie.Value); t != nil {
+			return &identity{name: t.name, role: t.role}
+		}
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	user, ok := a.users[username]
+	if !ok {
+		return nil
+	}
+
+	cacheKey := sha256.Sum256([]byte(username + ":" + password))
+	if expires, ok := a.cache.Load(cacheKey); ok && time.Now().Before(expires.(time.Time)) {
+		return &identity{name: username, role: user.role}
+	}
+	if bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)) != nil {
+		return nil
+	}
+	a.cache.Store(cacheKey, time.Now().Add(authCacheDuration))
+	return &identity{name: username, role: user.role}
+}
+
+// require only lets requests through from identities with at least the passed in role
+func (a *authenticator) require(min role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := a.authenticate(w, r)
+		if id == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Go Photo Frame"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if id.role < min {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, id)))
+	}
+}
+
+// requestIdentity returns the identity of a request that passed through require
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityContextKey).(*identity)
+	return id
+}
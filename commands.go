@@ -0,0 +1,445 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"go.etcd.io/bbolt"
+	"golang.org/x/oauth2"
+)
+
+// command is a subcommand of the executable, run after the config is loaded
+type command struct {
+	usage       string
+	description string
+	noStore     bool // the command doesn't open the data file
+	readOnly    bool // the command only reads the data file
+	run         func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve": {
+			usage:       "serve",
+			description: "run the photo frame server, the default when no command is given",
+			run:         serve,
+		},
+		"poll": {
+			usage:       "poll [provider]",
+			description: "fetch new images from every provider, or only the one named, once",
+			run:         pollCommand,
+		},
+		"import": {
+			usage:       "import <dir|zip>",
+			description: "add the images and videos in a directory or zip file",
+			run:         importCommand,
+		},
+		"export": {
+			usage:       "export <dir>",
+			description: "write the original of every image to a directory, with a json file of its metadata",
+			readOnly:    true,
+			run:         exportCommand,
+		},
+		"ls": {
+			usage:       "ls [-provider name] [-sender name] [-held] [-hidden]",
+			description: "list the stored images",
+			readOnly:    true,
+			run:         lsCommand,
+		},
+		"rm": {
+			usage:       "rm <key>...",
+			description: "remove images",
+			run:         rmCommand,
+		},
+		"prune": {
+			usage:       "prune",
+			description: "remove images over the configured storage limits and quotas",
+			run:         pruneCommand,
+		},
+		"authorize": {
+			usage:       "authorize <provider>",
+			description: "sign in to a provider's account, i.e. an email account using oauth2",
+			noStore:     true,
+			run:         authorizeCommand,
+		},
+		"config": {
+			usage:       "config check",
+			description: "validate the configuration",
+			noStore:     true,
+			run:         configCommand,
+		},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].description)
+	}
+	w.Flush()
+}
+
+func serve(args []string) error {
+	go func() {
+		stripHiddenImages()
+		// stored images are measured after they're transcoded, since only transcoded images can be decoded to measure
+		transcodeStoredImages()
+		measureStoredImages()
+		locateStoredImages()
+		// grouped after they're located, since events are split by where images were taken
+		groupStoredImages()
+		detectStoredFaces()
+		// focused after faces are detected, since faces are what they center on
+		focusStoredImages()
+	}()
+	go refreshStoreMetrics()
+	go reloadOnHangup()
+
+	startProviders(viper.GetDuration("newImagePollDuration"))
+	imageDuration, err := time.ParseDuration(viper.GetString("imageCycleDuration"))
+	if err != nil {
+		imageDuration = 3 * time.Second
+	}
+	return startServer(viper.GetString("port"), imageDuration, newQueue(viper.GetInt("maxImageCount"),
+		viper.GetString("imageOrder")))
+}
+
+func pollCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: poll [provider]")
+	}
+	polled := false
+	for _, p := range providers {
+		if len(args) == 1 && p.name() != args[0] {
+			continue
+		}
+		polled = true
+		if err := pollProvider(p); err != nil {
+			return err
+		}
+	}
+	if !polled && len(args) == 1 {
+		return fmt.Errorf("Provider %s is not configured", args[0])
+	}
+	return nil
+}
+
+func authorizeCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: authorize <provider>")
+	}
+	a, err := providerAuthorizer(args[0])
+	if err != nil {
+		return err
+	}
+	// while the frame is running it has the data file open, so the token is left for it to store
+	err = openStore(viper.GetString("dataFile"), false)
+	_, running := err.(*storeInUseError)
+	if err != nil && !running {
+		return err
+	}
+	defer closeStore()
+
+	err = a.authorize(context.Background(), func(auth *oauth2.DeviceAuthResponse) {
+		if auth.VerificationURIComplete != "" {
+			fmt.Printf("Open %s to authorize the frame\n", auth.VerificationURIComplete)
+			return
+		}
+		fmt.Printf("Open %s and enter the code %s to authorize the frame\n", auth.VerificationURI, auth.UserCode)
+	})
+	if err != nil {
+		return err
+	}
+	if running {
+		fmt.Println("Authorized, the running frame will use the account the next time it connects")
+		return nil
+	}
+	fmt.Println("Authorized")
+	return nil
+}
+
+func importCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: import <dir|zip>")
+	}
+	var images []*image
+	var added, skipped int
+	flush := func() error {
+		if len(images) == 0 {
+			return nil
+		}
+		err := addImages(images)
+		added += len(images)
+		images = images[:0]
+		return err
+	}
+	found := func(name string, data []byte, modified time.Time) error {
+		img, err := fileImage("import", name, data, modified)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", name, err)
+			skipped++
+			return nil
+		}
+		images = append(images, img)
+		if len(images) >= maxImagesPerPoll {
+			return flush()
+		}
+		return nil
+	}
+
+	var err error
+	if strings.ToLower(filepath.Ext(args[0])) == ".zip" {
+		err = importZip(args[0], found)
+	} else {
+		err = importDir(args[0], found)
+	}
+	if err != nil {
+		return err
+	}
+	if err = flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d files, skipped %d\n", added, skipped)
+	return nil
+}
+
+func importDir(dir string, found func(name string, data []byte, modified time.Time) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return found(path, data, info.ModTime())
+	})
+}
+
+func importZip(file string, found func(name string, data []byte, modified time.Time) error) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(filepath.Base(f.Name), ".") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err = found(f.Name, data, f.Modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportInfo is the metadata written next to each exported image
+type exportInfo struct {
+	imageInfo
+	Held     bool      `json:"held,omitempty"`
+	Pinned   bool      `json:"pinned,omitempty"`
+	Favorite bool      `json:"favorite,omitempty"`
+	Rating   int       `json:"rating,omitempty"`
+	Hidden   bool      `json:"hidden,omitempty"`
+	People   []string  `json:"people,omitempty"`
+	Place    string    `json:"place,omitempty"`
+	Location *geoPoint `json:"location,omitempty"`
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func exportCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: export <dir>")
+	}
+	dir := args[0]
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = store.ForEach(nil, func(img *image) error {
+		if img.Hidden {
+			// only a record of hidden images is kept
+			return nil
+		}
+		data, ctype := img.Data, img.ContentType
+		orig := &original{}
+		err := store.Get(img.Key, orig)
+		if err == nil {
+			data, ctype = orig.Data, orig.ContentType
+		} else if err != bh.ErrNotFound {
+			return err
+		}
+
+		name := filepath.Join(dir, unsafeFilename.ReplaceAllString(img.Key, "_"))
+		err = ioutil.WriteFile(name+mediaExtension(ctype), data, 0644)
+		if err != nil {
+			return err
+		}
+
+		info := exportInfo{
+			imageInfo: newImageInfo(img),
+			Held:      img.Held,
+			Pinned:    img.Pinned,
+			Favorite:  img.Favorite,
+			Rating:    img.Rating,
+			Hidden:    img.Hidden,
+			People:    img.People,
+			Place:     img.Place,
+			Location:  img.Location,
+		}
+		info.ContentType = ctype
+		sidecar, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		count++
+		return ioutil.WriteFile(name+".json", sidecar, 0644)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d images to %s\n", count, dir)
+	return nil
+}
+
+// mediaExtension returns the file extension for a content type, preferring the one named after it
+func mediaExtension(ctype string) string {
+	subtype := ctype[strings.Index(ctype, "/")+1:]
+	ext := ""
+	for e, t := range mediaExtensions {
+		if t != ctype {
+			continue
+		}
+		if e[1:] == subtype {
+			return e
+		}
+		if ext == "" || len(e) < len(ext) || (len(e) == len(ext) && e < ext) {
+			ext = e
+		}
+	}
+	return ext
+}
+
+func lsCommand(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	provider := flags.String("provider", "", "only list images from this provider")
+	sender := flags.String("sender", "", "only list images from this sender or uploader")
+	held := flags.Bool("held", false, "only list images held for moderation")
+	hidden := flags.Bool("hidden", false, "only list hidden images")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tPROVIDER\tDATE\tTYPE\tSIZE\tFLAGS")
+	err := store.ForEach(nil, func(img *image) error {
+		if (*provider != "" && img.Provider != *provider) || (*sender != "" && img.Sender != *sender) ||
+			(*held && !img.Held) || (*hidden && !img.Hidden) {
+			return nil
+		}
+		var flags []string
+		for flag, set := range map[string]bool{
+			"held": img.Held, "pinned": img.Pinned, "favorite": img.Favorite, "hidden": img.Hidden,
+		} {
+			if set {
+				flags = append(flags, flag)
+			}
+		}
+		if img.Rating > 0 {
+			flags = append(flags, fmt.Sprintf("rating=%d", img.Rating))
+		}
+		sort.Strings(flags)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", img.Key, img.Provider, img.Date.Format(time.RFC3339),
+			img.ContentType, img.Size, strings.Join(flags, ","))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func rmCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: rm <key>...")
+	}
+	for _, key := range args {
+		err := deleteImage(key)
+		if err == bh.ErrNotFound {
+			return fmt.Errorf("Image %s not found", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneCommand(args []string) error {
+	before, err := store.Count(&stored{}, bh.Where("Hidden").Eq(false))
+	if err != nil {
+		return err
+	}
+	err = store.Bolt().Update(func(tx *bbolt.Tx) error {
+		return evict(tx)
+	})
+	if err != nil {
+		return err
+	}
+	after, err := store.Count(&stored{}, bh.Where("Hidden").Eq(false))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d images, %d remaining\n", before-after, after)
+	return nil
+}
+
+func configCommand(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("Usage: config check")
+	}
+	// the config has been checked before any command runs
+	fmt.Printf("Configuration %s is valid\n", viper.ConfigFileUsed())
+	return nil
+}
@@ -0,0 +1,496 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// settings are the top level settings of the config file, auth and providers are decoded into their
+// own types when they are loaded
+type settings struct {
+	Port                 string        `config:"port"`
+	ImageCycleDuration   time.Duration `config:"imageCycleDuration"`
+	MaxImageCount        int           `config:"maxImageCount"`
+	MaxStorageSize       string        `config:"maxStorageSize"`
+	EvictionPolicy       string        `config:"evictionPolicy"`
+	UnratedRating        int           `config:"unratedRating"`
+	NewImagePollDuration time.Duration `config:"newImagePollDuration"`
+	DataFile             string        `config:"dataFile"`
+	ImageOrder           string        `config:"imageOrder"`
+	EventGap             time.Duration `config:"eventGap"`
+	EventDistance        float64       `config:"eventDistance"`
+	StoryTitles          bool          `config:"storyTitles"`
+	Transition           string        `config:"transition"`
+	TransitionDuration   time.Duration `config:"transitionDuration"`
+	PairImages           bool          `config:"pairImages"`
+	Fit                  string        `config:"fit"`
+	People               []string      `config:"people"`
+	Countries            []string      `config:"countries"`
+	ShowPlace            bool          `config:"showPlace"`
+	FavoriteWeight       float64       `config:"favoriteWeight"`
+	RatingWeight         float64       `config:"ratingWeight"`
+	HeifCommand          []string      `config:"heifCommand"`
+	SecretKey            secret        `config:"secretKey"`
+	Faces                struct {
+		Cascade    string  `config:"cascade"`
+		MinQuality float64 `config:"minQuality"`
+	} `config:"faces"`
+	Places struct {
+		File string `config:"file"`
+	} `config:"places"`
+	TLS struct {
+		Mode     string `config:"mode"`
+		CertFile string `config:"certFile"`
+		KeyFile  string `config:"keyFile"`
+		ACME     struct {
+			Domains      []string `config:"domains"`
+			Email        string   `config:"email"`
+			DirectoryURL string   `config:"directoryURL"`
+			CAFile       string   `config:"caFile"`
+			HTTPPort     string   `config:"httpPort"`
+		} `config:"acme"`
+	} `config:"tls"`
+	Auth      map[string]interface{} `config:"auth"`
+	Providers map[string]interface{} `config:"providers"`
+}
+
+// loadConfig validates the config file and sets up the providers, returning every problem found
+func loadConfig() []error {
+	errs := checkSettings()
+	if _, err := newAuthenticator(); err != nil {
+		errs = appendErrors(errs, err)
+	}
+	errs = append(errs, loadProviders(viper.GetStringMap("providers"))...)
+
+	// report errors in the order they appear in the file
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorLine(errs[i]) < errorLine(errs[j])
+	})
+	return errs
+}
+
+func errorLine(err error) int {
+	if err, ok := err.(*configError); ok {
+		_, line, _ := configLine(err.path)
+		return line
+	}
+	return 0
+}
+
+func checkSettings() []error {
+	section := newConfigSection("", viper.AllSettings())
+	s := &settings{}
+	errs := appendErrors(nil, section.check(s))
+
+	if _, err := parseSize(s.MaxStorageSize); err != nil {
+		errs = append(errs, section.errorf("maxStorageSize", "%s", err))
+	}
+	switch s.EvictionPolicy {
+	case evictOldest, evictLeastShown, evictLowestRated:
+	default:
+		errs = append(errs, section.errorf("evictionPolicy", "must be %s, %s or %s, not %q", evictOldest,
+			evictLeastShown, evictLowestRated, s.EvictionPolicy))
+	}
+	if s.UnratedRating < 1 || s.UnratedRating > 5 {
+		errs = append(errs, section.errorf("unratedRating", "must be from 1 to 5"))
+	}
+	switch s.ImageOrder {
+	case queueOrderDefault, queueOrderRandom, queueOrderNewest, queueOrderOldest, queueOrderStory:
+	default:
+		errs = append(errs, section.errorf("imageOrder", "must be %s, %s, %s, %s or %s, not %q", queueOrderDefault,
+			queueOrderRandom, queueOrderNewest, queueOrderOldest, queueOrderStory, s.ImageOrder))
+	}
+	if s.EventGap <= 0 {
+		errs = append(errs, section.errorf("eventGap", "must be more than 0"))
+	}
+	if s.EventDistance <= 0 {
+		errs = append(errs, section.errorf("eventDistance", "must be more than 0"))
+	}
+	if !validTransition(s.Transition) {
+		errs = append(errs, section.errorf("transition", "must be %s, %s, %s, %s or %s, not %q", transitionNone,
+			transitionCrossfade, transitionSlide, transitionZoom, transitionKenBurns, s.Transition))
+	}
+	if !validFit(s.Fit) {
+		errs = append(errs, section.errorf("fit", "must be %s, %s or %s, not %q", fitContain, fitCover, fitBlur, s.Fit))
+	}
+	if _, err := faceDetector(); err != nil {
+		errs = append(errs, section.errorf("faces.cascade", "%s", err))
+	}
+	if _, err := loadPlaces(); err != nil {
+		errs = append(errs, section.errorf("places.file", "%s", err))
+	}
+	for _, country := range s.Countries {
+		if countryCode(country) == "" {
+			errs = append(errs, section.errorf("countries", "%q isn't a country name or ISO 3166 code", country))
+		}
+	}
+	switch s.TLS.Mode {
+	case tlsOff, tlsSelfSigned:
+	case tlsFiles:
+		if s.TLS.CertFile == "" || s.TLS.KeyFile == "" {
+			errs = append(errs, section.errorf("tls.mode", "certFile and keyFile are required for %s", tlsFiles))
+		}
+	case tlsACME:
+		if len(s.TLS.ACME.Domains) == 0 {
+			errs = append(errs, section.errorf("tls.acme", "domains are required for %s", tlsACME))
+		}
+	default:
+		errs = append(errs, section.errorf("tls.mode", "must be blank, %s, %s or %s, not %q", tlsFiles,
+			tlsSelfSigned, tlsACME, s.TLS.Mode))
+	}
+	return errs
+}
+
+// configError is a problem with a setting, located by its path, i.e. providers.email.port
+type configError struct {
+	path string
+	msg  string
+}
+
+func (e *configError) Error() string {
+	if file, line, path := configLine(e.path); line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", file, line, path, e.msg)
+	}
+	return fmt.Sprintf("%s: %s", e.path, e.msg)
+}
+
+// configErrors are all of the problems found in a section
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// appendErrors appends err to errs, flattening configErrors
+func appendErrors(errs []error, err error) []error {
+	if err == nil {
+		return errs
+	}
+	if list, ok := err.(configErrors); ok {
+		return append(errs, list...)
+	}
+	return append(errs, err)
+}
+
+// configSection is part of the config, decoded into structs whose fields are tagged with their config key.
+// A section can be decoded into more than one struct, and keys not used by any of them are reported
+// by unknownKeys
+type configSection struct {
+	path   string
+	values map[string]interface{}
+	used   map[string]bool
+}
+
+func newConfigSection(path string, values map[string]interface{}) *configSection {
+	return &configSection{path: path, values: values, used: make(map[string]bool)}
+}
+
+// decode sets the fields of the struct out points to from the section
+func (c *configSection) decode(out interface{}) error {
+	var errs configErrors
+	decodeStruct(c.path, c.values, reflect.ValueOf(out).Elem(), c.used, &errs)
+	return errs.err()
+}
+
+// check decodes a section that is described by a single struct
+func (c *configSection) check(out interface{}) error {
+	errs := appendErrors(nil, c.decode(out))
+	errs = appendErrors(errs, c.unknownKeys())
+	return configErrors(errs).err()
+}
+
+func (c *configSection) unknownKeys() error {
+	var errs configErrors
+	for key := range c.values {
+		if !c.used[key] {
+			errs = append(errs, &configError{path: joinConfigPath(c.path, key), msg: "unknown setting"})
+		}
+	}
+	return errs.err()
+}
+
+// errorf returns an error for a key of the section
+func (c *configSection) errorf(key, format string, args ...interface{}) error {
+	return &configError{path: joinConfigPath(c.path, key), msg: fmt.Sprintf(format, args...)}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	secretType   = reflect.TypeOf(secret(""))
+)
+
+// decodeStruct decodes values into the struct v, keys are matched without case because viper lowercases
+// them.  If used is nil, keys that don't match a field are reported as errors
+func decodeStruct(path string, values map[string]interface{}, v reflect.Value, used map[string]bool,
+	errs *configErrors) {
+	fields := make(map[string]int)
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("config"); tag != "" {
+			fields[strings.ToLower(tag)] = i
+		}
+	}
+
+	for key, raw := range values {
+		i, ok := fields[strings.ToLower(key)]
+		if !ok {
+			if used == nil {
+				*errs = append(*errs, &configError{path: joinConfigPath(path, key), msg: "unknown setting"})
+			}
+			continue
+		}
+		if used != nil {
+			used[key] = true
+		}
+		tag := v.Type().Field(i).Tag.Get("config")
+		decodeValue(joinConfigPath(path, tag), raw, v.Field(i), errs)
+	}
+}
+
+func decodeValue(path string, raw interface{}, v reflect.Value, errs *configErrors) {
+	if raw == nil {
+		return
+	}
+	mismatch := func(expected string) {
+		*errs = append(*errs, &configError{path: path, msg: fmt.Sprintf("expected %s, got %s", expected,
+			describeConfigValue(raw))})
+	}
+
+	if v.Type() == durationType {
+		s, ok := raw.(string)
+		if !ok {
+			mismatch("a duration like 30s or 1h")
+			return
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			*errs = append(*errs, &configError{path: path, msg: fmt.Sprintf("invalid duration %q, use a "+
+				"duration like 30s or 1h", s)})
+			return
+		}
+		v.SetInt(int64(d))
+		return
+	}
+
+	if v.Type() == secretType {
+		ref, ok := raw.(string)
+		if !ok {
+			mismatch("a string")
+			return
+		}
+		value, err := resolveSecret(ref)
+		if err != nil {
+			*errs = append(*errs, &configError{path: path, msg: err.Error()})
+			return
+		}
+		v.SetString(value)
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		switch raw := raw.(type) {
+		case string:
+			v.SetString(raw)
+		case int, int64, float64:
+			// ports and the like are often written without quotes
+			v.SetString(fmt.Sprint(raw))
+		case time.Time:
+			v.SetString(raw.Format("2006-01-02"))
+		default:
+			mismatch("a string")
+		}
+	case reflect.Bool:
+		b, ok := raw.(bool)
+		if !ok {
+			mismatch("true or false")
+			return
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		switch raw := raw.(type) {
+		case int:
+			v.SetInt(int64(raw))
+		case int64:
+			v.SetInt(raw)
+		case float64:
+			if raw != float64(int64(raw)) {
+				mismatch("a whole number")
+				return
+			}
+			v.SetInt(int64(raw))
+		default:
+			mismatch("a whole number")
+		}
+	case reflect.Float64:
+		switch raw := raw.(type) {
+		case int:
+			v.SetFloat(float64(raw))
+		case int64:
+			v.SetFloat(float64(raw))
+		case float64:
+			v.SetFloat(raw)
+		default:
+			mismatch("a number")
+		}
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			if strs, isStrings := raw.([]string); isStrings {
+				// defaults set in code
+				for _, s := range strs {
+					list = append(list, s)
+				}
+			} else {
+				mismatch("a list")
+				return
+			}
+		}
+		slice := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i := range list {
+			decodeValue(path+"["+strconv.Itoa(i)+"]", list[i], slice.Index(i), errs)
+		}
+		v.Set(slice)
+	case reflect.Struct:
+		values, ok := configMap(raw)
+		if !ok {
+			mismatch("a group of settings")
+			return
+		}
+		decodeStruct(path, values, v, nil, errs)
+	case reflect.Map, reflect.Interface:
+		values, ok := configMap(raw)
+		if !ok {
+			mismatch("a group of settings")
+			return
+		}
+		v.Set(reflect.ValueOf(values))
+	}
+}
+
+// configMap returns a group of settings as a map, whichever way it was parsed
+func configMap(raw interface{}) (map[string]interface{}, bool) {
+	switch raw := raw.(type) {
+	case map[string]interface{}:
+		return raw, true
+	case map[interface{}]interface{}:
+		values := make(map[string]interface{}, len(raw))
+		for k, v := range raw {
+			values[fmt.Sprint(k)] = v
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+func describeConfigValue(raw interface{}) string {
+	switch raw := raw.(type) {
+	case string:
+		return fmt.Sprintf("%q", raw)
+	case bool:
+		return strconv.FormatBool(raw)
+	case int, int64, float64:
+		return fmt.Sprintf("the number %v", raw)
+	case []interface{}, []string:
+		return "a list"
+	}
+	if _, ok := configMap(raw); ok {
+		return "a group of settings"
+	}
+	return fmt.Sprintf("%v", raw)
+}
+
+var configFile = struct {
+	sync.Once
+	root *yaml.Node
+}{}
+
+// configLine returns the line a setting is on in a yaml config file, or the closest line found, or 0
+// if the config isn't yaml.  The path is returned with keys spelled as they are in the file, since viper
+// lowercases them
+func configLine(path string) (string, int, string) {
+	file := viper.ConfigFileUsed()
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext != ".yaml" && ext != ".yml" {
+		return file, 0, path
+	}
+
+	configFile.Do(func() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return
+		}
+		root := &yaml.Node{}
+		if yaml.Unmarshal(data, root) == nil && len(root.Content) > 0 {
+			configFile.root = root.Content[0]
+		}
+	})
+	node := configFile.root
+	if node == nil {
+		return file, 0, path
+	}
+
+	line := 0
+	parts := strings.Split(path, ".")
+	for p, part := range parts {
+		name, index := part, -1
+		if i := strings.Index(part, "["); i != -1 {
+			name = part[:i]
+			index, _ = strconv.Atoi(strings.TrimSuffix(part[i+1:], "]"))
+		}
+
+		var next *yaml.Node
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if strings.EqualFold(node.Content[i].Value, name) {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					parts[p] = node.Content[i].Value + part[len(name):]
+					break
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		if index >= 0 {
+			if next.Kind != yaml.SequenceNode || index >= len(next.Content) {
+				break
+			}
+			next = next.Content[index]
+			line = next.Line
+		}
+		node = next
+	}
+	return file, line, strings.Join(parts, ".")
+}
@@ -4,109 +4,589 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
 	bh "github.com/timshannon/bolthold"
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/oauth2"
+)
+
+const (
+	emailIMAP    = "imap"
+	emailPOP3    = "pop3"
+	emailMbox    = "mbox"
+	emailMaildir = "maildir"
 )
 
 type email struct {
+	protocol string
+	path     string // local mbox file or maildir directory
 	server   string
 	port     string
 	username string
 	password string
+	oauth    *oauthClient // authenticates with an access token instead of the password
 	mailbox  string
 	from     []string
 	to       string
+	idle     bool
+	since    time.Time
+
+	// actions applied to emails after their images have been imported
+	markSeen bool
+	moveTo   string
+	addFlag  string
+
+	linkedImages bool
+
+	// sender verification and moderation
+	verifyDKIM        bool
+	trustedAuthServer string
+	moderate          bool
+	senders           []emailSender
+}
+
+// emailSender is a rule for emails from a specific address, images from a configured sender are
+// always approved
+type emailSender struct {
+	address string
+	caption bool // caption images with the sender's name
+}
+
+const (
+	emailMinBackoff = 5 * time.Second
+	emailMaxBackoff = 5 * time.Minute
+
+	// inline and linked images smaller than this are skipped as signature logos or tracking pixels
+	emailMinInlineSize = 10 * 1024
+
+	// how long downloading a linked image can take, so a dead link can't hold up the mailbox
+	emailLinkTimeout = 30 * time.Second
+)
+
+// emailLinkClient downloads images linked in emails.  Anyone can send a link, so it only connects to
+// public addresses, which keeps emails from reaching the frame's own network
+var emailLinkClient = &http.Client{
+	Timeout: emailLinkTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: emailLinkTimeout,
+			// checked after the host is resolved, so a public name can't point at a private address
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("Linked images can't be downloaded from %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: emailLinkTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("Too many redirects")
+		}
+		return checkLink(req.URL)
+	},
 }
 
-func (e *email) initialize(config providerConfig) error {
-	server, serverOk := config.getString("server")
-	port, portOk := config.getString("port")
-	username, usernameOk := config.getString("username")
-	password, passwordOk := config.getString("password")
-	mailbox, mailboxOk := config.getString("mailbox")
-	if !serverOk || !portOk || !usernameOk || !passwordOk || !mailboxOk {
-		return fmt.Errorf("Invalid email config")
-	}
-	e.server = server
-	e.port = port
-	e.username = username
-	e.password = password
-	e.mailbox = mailbox
-	e.from, _ = config.getStringSlice("from")
-	e.to, _ = config.getString("to")
+// publicIP returns whether an address is reachable from the internet, rather than on the local network
+// or the machine itself
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// checkLink returns an error if a linked image isn't on the web
+func checkLink(link *url.URL) error {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return fmt.Errorf("Linked images must be http or https, not %s", link.Scheme)
+	}
+	return nil
+}
+
+// mediaExtensions are used to find images and videos in parts without a specific content type
+var mediaExtensions = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".dng":  "image/x-adobe-dng",
+	".cr2":  "image/x-canon-cr2",
+	".nef":  "image/x-nikon-nef",
+	".arw":  "image/x-sony-arw",
+	".orf":  "image/x-olympus-orf",
+	".rw2":  "image/x-panasonic-rw2",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime", // also the motion part of a Live Photo, see pairLivePhotos
+	".webm": "video/webm",
+}
+
+// emailState tracks which messages in a mailbox have already been processed.  For IMAP it's the
+// highest UID processed, which is only meaningful as long as the mailbox's UIDVALIDITY hasn't changed,
+// for mbox files LastUID is the number of messages processed, and for POP3 and maildir, which have no
+// ordering, Seen is the set of unique message ids processed
+type emailState struct {
+	Key         string `boltholdKey:"Key"`
+	UIDValidity uint32
+	LastUID     uint32
+	Seen        map[string]bool
+}
+
+type emailConfig struct {
+	Protocol          string      `config:"protocol"`
+	Path              string      `config:"path"`
+	Server            string      `config:"server"`
+	Port              string      `config:"port"`
+	Username          string      `config:"username"`
+	Password          secret      `config:"password"`
+	Mailbox           string      `config:"mailbox"`
+	From              []string    `config:"from"`
+	To                string      `config:"to"`
+	Idle              bool        `config:"idle"`
+	Since             string      `config:"since"`
+	MarkSeen          bool        `config:"markSeen"`
+	MoveTo            string      `config:"moveTo"`
+	AddFlag           string      `config:"addFlag"`
+	LinkedImages      bool        `config:"linkedImages"`
+	VerifyDKIM        bool        `config:"verifyDKIM"`
+	TrustedAuthServer string      `config:"trustedAuthServer"`
+	Moderate          bool        `config:"moderate"`
+	OAuth2            oauthConfig `config:"oauth2"`
+	Senders           []struct {
+		Address string `config:"address"`
+		Caption bool   `config:"caption"`
+	} `config:"senders"`
+}
+
+func (e *email) initialize(config *configSection) error {
+	settings := emailConfig{Protocol: emailIMAP}
+	errs := configErrors(appendErrors(nil, config.decode(&settings)))
+	required := func(key, value string) {
+		if value == "" {
+			errs = append(errs, config.errorf(key, "required for protocol %s", settings.Protocol))
+		}
+	}
+
+	switch settings.Protocol {
+	case emailIMAP, emailPOP3:
+		required("server", settings.Server)
+		required("port", settings.Port)
+		required("username", settings.Username)
+		if !settings.OAuth2.configured() {
+			required("password", string(settings.Password))
+		}
+		if settings.Protocol == emailIMAP {
+			required("mailbox", settings.Mailbox)
+		}
+	case emailMbox, emailMaildir:
+		required("path", settings.Path)
+	default:
+		errs = append(errs, config.errorf("protocol", "must be %s, %s, %s or %s, not %q", emailIMAP, emailPOP3,
+			emailMbox, emailMaildir, settings.Protocol))
+	}
+
+	if settings.Since != "" {
+		t, err := time.Parse("2006-01-02", settings.Since)
+		if err != nil {
+			errs = append(errs, config.errorf("since", "invalid date %q, use the format 2019-01-31", settings.Since))
+		}
+		e.since = t
+	}
+
+	if settings.OAuth2.configured() {
+		if settings.Protocol != emailIMAP {
+			errs = append(errs, config.errorf("oauth2", "only supported for protocol %s", emailIMAP))
+		}
+		client, err := newOAuthClient(config, "oauth2", settings.Username+"@"+settings.Server, settings.OAuth2)
+		errs = appendErrors(errs, err)
+		e.oauth = client
+	}
+
+	for i, s := range settings.Senders {
+		if s.Address == "" {
+			errs = append(errs, config.errorf(fmt.Sprintf("senders[%d].address", i), "required"))
+		}
+		e.senders = append(e.senders, emailSender{address: s.Address, caption: s.Caption})
+	}
+
+	e.protocol = settings.Protocol
+	e.path = settings.Path
+	e.server = settings.Server
+	e.port = settings.Port
+	e.username = settings.Username
+	e.password = string(settings.Password)
+	e.mailbox = settings.Mailbox
+	e.from = settings.From
+	e.to = settings.To
+	e.idle = settings.Idle
+	e.markSeen = settings.MarkSeen
+	e.moveTo = settings.MoveTo
+	e.addFlag = settings.AddFlag
+	e.linkedImages = settings.LinkedImages
+	e.verifyDKIM = settings.VerifyDKIM
+	e.trustedAuthServer = settings.TrustedAuthServer
+	e.moderate = settings.Moderate
+	return errs.err()
+}
+
+// reloadSecrets uses the password and oauth client secret in the reloaded config
+func (e *email) reloadSecrets(config *configSection) error {
+	settings := emailConfig{}
+	if err := config.decode(&settings); err != nil {
+		return err
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	e.password = string(settings.Password)
+	if e.oauth != nil {
+		e.oauth.config.ClientSecret = string(settings.OAuth2.ClientSecret)
+	}
 	return nil
 }
 
 func (e *email) name() string { return "email" }
-func (e *email) getImages(lastImage *image) ([]*image, error) {
-	var images []*image
 
+func (e *email) connect() (*client.Client, error) {
 	c, err := client.DialTLS(fmt.Sprintf("%s:%s", e.server, e.port), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	defer c.Logout()
+	if e.oauth != nil {
+		auth, err := e.oauth.saslClient(e.username)
+		if err == nil {
+			err = c.Authenticate(auth)
+		}
+		if err != nil {
+			c.Logout()
+			return nil, err
+		}
+	} else if err := c.Login(e.username, readSecret(&e.password)); err != nil {
+		c.Logout()
+		return nil, err
+	}
 
-	if err := c.Login(e.username, e.password); err != nil {
+	if _, err := c.Select(e.mailbox, false); err != nil {
+		c.Logout()
 		return nil, err
 	}
 
-	mbox, err := c.Select(e.mailbox, false)
+	return c, nil
+}
+
+// getImages imports any new emails since the last poll directly, so that the processed messages are
+// only recorded once the images have been stored
+func (e *email) getImages(lastImage *image) ([]*image, error) {
+	switch e.protocol {
+	case emailPOP3:
+		return nil, e.syncPOP3(e.addFound)
+	case emailMbox:
+		return nil, e.syncMbox(e.addFound)
+	case emailMaildir:
+		return nil, e.syncMaildir(e.addFound)
+	}
+
+	c, err := e.connect()
 	if err != nil {
 		return nil, err
 	}
 
-	if mbox.Messages == 0 {
-		return nil, nil
+	defer c.Logout()
+
+	return nil, e.sync(c, e.addFound)
+}
+
+// addFound stores the images found in a poll, which aren't returned to be counted with other providers'
+func (e *email) addFound(images []*image) error {
+	imagesFetched.WithLabelValues(e.name()).Add(float64(len(images)))
+	return addImages(images)
+}
+
+func (e *email) watching() bool { return e.idle && e.protocol == emailIMAP }
+
+func (e *email) authorizing() bool { return e.oauth != nil }
+
+func (e *email) authorize(ctx context.Context, prompt func(auth *oauth2.DeviceAuthResponse)) error {
+	return e.oauth.authorize(ctx, prompt)
+}
+
+// watch keeps a connection to the mailbox open with IDLE, and imports new emails as soon as the
+// server reports them, reconnecting with an increasing backoff if the connection fails
+func (e *email) watch(found func(images []*image) error) {
+	backoff := emailMinBackoff
+	for {
+		start := time.Now()
+		err := e.idleMailbox(found)
+		recordProviderResult(e.name(), err)
+		if time.Since(start) > emailMaxBackoff {
+			// connection was healthy for a while, so start backing off from the beginning
+			backoff = emailMinBackoff
+		}
+		log.Printf("Error watching mailbox %s, reconnecting in %s: %s\n", e.mailbox, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > emailMaxBackoff {
+			backoff = emailMaxBackoff
+		}
 	}
+}
 
-	for i := mbox.Messages; i != 0; i-- {
-		imgs, err := e.getImagesFromEmail(c, i)
+func (e *email) idleMailbox(found func(images []*image) error) error {
+	c, err := e.connect()
+	if err != nil {
+		return err
+	}
+	updates := make(chan client.Update, 10)
+	defer func() {
+		if c.Logout() != nil {
+			c.Terminate()
+		}
+		// the client sends updates until its reader stops, so the channel is only closed after that
+		<-c.LoggedOut()
+		c.Updates = nil
+		close(updates)
+	}()
+
+	// the client blocks until updates are read, so always drain them and only signal that
+	// the mailbox changed
+	changed := make(chan struct{}, 1)
+	go func() {
+		for update := range updates {
+			if _, ok := update.(*client.MailboxUpdate); ok {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	c.Updates = updates
+
+	for {
+		err = e.sync(c, found)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		recordProviderResult(e.name(), nil)
 
-		images = append(images, imgs...)
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Idle(stop, nil)
+		}()
 
-		if lastImage != nil {
-			lastFound := false
-			for k := range imgs {
-				if imgs[k].Key == lastImage.Key {
-					lastFound = true
-					break
-				}
+		select {
+		case <-changed:
+			close(stop)
+			if err = <-done; err != nil {
+				return err
 			}
-			if lastFound {
-				break
+		case err = <-done:
+			if err == nil {
+				err = fmt.Errorf("IDLE ended unexpectedly")
 			}
+			return err
 		}
 	}
-
-	return images, nil
 }
 
-func (e *email) getImagesFromEmail(client *client.Client, sequence uint32) ([]*image, error) {
+// sync imports the images from all emails newer than the last processed UID of the selected
+// mailbox
+func (e *email) sync(c *client.Client, found func(images []*image) error) error {
+	state, err := e.state()
+	if err != nil {
+		return err
+	}
+
+	if state.UIDValidity != c.Mailbox().UidValidity {
+		// UIDs have been reassigned by the server and the old ones are meaningless
+		state.UIDValidity = c.Mailbox().UidValidity
+		state.LastUID = 0
+	}
+
+	uids, err := c.UidSearch(e.searchCriteria(state.LastUID))
+	if err != nil {
+		return err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
 	var images []*image
+	imported := new(imap.SeqSet)
+	flush := func() error {
+		if err := e.flush(images, state, found); err != nil {
+			return err
+		}
+		images = nil
+		if imported.Empty() {
+			return nil
+		}
+		err := e.afterImport(c, imported)
+		imported.Clear()
+		return err
+	}
+
+	for _, uid := range uids {
+		// a search for n:* always includes the last message, even if its UID is lower than n
+		if uid <= state.LastUID {
+			continue
+		}
+		imgs, err := e.getImagesFromEmail(c, uid)
+		if err != nil {
+			return err
+		}
+		images = append(images, imgs...)
+		state.LastUID = uid
+		if len(imgs) > 0 {
+			imported.AddNum(uid)
+		}
+
+		if len(images) >= maxImagesPerPoll {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// searchCriteria filters emails on the server, so only new messages matching the from, to and since
+// config are ever downloaded
+func (e *email) searchCriteria(lastUID uint32) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(lastUID+1, 0)
+	criteria.Since = e.since
+
+	// unknown senders still need to be downloaded to be moderated
+	from := e.allowedAddresses()
+	switch {
+	case e.moderate, len(from) == 0:
+	case len(from) == 1:
+		criteria.Header.Add("From", from[0])
+	default:
+		criteria.Or = append(criteria.Or, [2]*imap.SearchCriteria{
+			anyHeaderCriteria("From", from[:1]),
+			anyHeaderCriteria("From", from[1:]),
+		})
+	}
+
+	if e.to != "" {
+		criteria.Header.Add("To", e.to)
+	}
+	return criteria
+}
+
+// anyHeaderCriteria matches a header against any of the passed in values
+func anyHeaderCriteria(key string, values []string) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	if len(values) == 1 {
+		criteria.Header.Add(key, values[0])
+		return criteria
+	}
+	criteria.Or = [][2]*imap.SearchCriteria{{
+		anyHeaderCriteria(key, values[:1]),
+		anyHeaderCriteria(key, values[1:]),
+	}}
+	return criteria
+}
+
+func (e *email) afterImport(c *client.Client, uids *imap.SeqSet) error {
+	var flags []interface{}
+	if e.markSeen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if e.addFlag != "" {
+		flags = append(flags, e.addFlag)
+	}
+	if len(flags) > 0 {
+		err := c.UidStore(uids, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.moveTo != "" {
+		return c.UidMove(uids, e.moveTo)
+	}
+	return nil
+}
+
+// flush hands off any found images, and then records the progress through the mailbox
+func (e *email) flush(images []*image, state *emailState, found func(images []*image) error) error {
+	if len(images) > 0 {
+		if err := found(images); err != nil {
+			return err
+		}
+	}
+	return store.Upsert(state.Key, state)
+}
+
+func (e *email) state() (*emailState, error) {
+	state := &emailState{}
+	key := fmt.Sprintf("%s@%s:%s/%s", e.username, e.server, e.port, e.mailbox)
+	if e.path != "" {
+		key = fmt.Sprintf("%s:%s", e.protocol, e.path)
+	}
+	err := store.Get(key, state)
+	if err == bh.ErrNotFound {
+		return &emailState{Key: key, Seen: make(map[string]bool)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.Seen == nil {
+		state.Seen = make(map[string]bool)
+	}
+	return state, nil
+}
+
+func (e *email) getImagesFromEmail(client *client.Client, uid uint32) ([]*image, error) {
 	seqset := new(imap.SeqSet)
-	seqset.AddNum(sequence)
+	seqset.AddNum(uid)
 
 	// Get the whole message body
-	section := &imap.BodySectionName{}
+	// peek so that emails are only marked as seen if configured
+	section := &imap.BodySectionName{Peek: true}
 	items := []imap.FetchItem{section.FetchItem()}
 
 	messages := make(chan *imap.Message, 1)
 	var err error
 	go func() {
-		err = client.Fetch(seqset, items, messages)
+		err = client.UidFetch(seqset, items, messages)
 	}()
 
 	msg := <-messages
@@ -123,35 +603,36 @@ func (e *email) getImagesFromEmail(client *client.Client, sequence uint32) ([]*i
 		return nil, fmt.Errorf("Server didn't return message body")
 	}
 
+	return e.imagesFromMessage(fmt.Sprintf("%s.%d", e.mailbox, msg.Uid), r)
+}
+
+// imagesFromMessage returns all of the images in a raw email message, keys are prefixed with the
+// passed in keyPrefix which must uniquely identify the message
+func (e *email) imagesFromMessage(keyPrefix string, r io.Reader) ([]*image, error) {
+	// the raw message is needed to verify DKIM signatures
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new mail reader
-	mr, err := mail.CreateReader(r)
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
 	if err != nil {
 		return nil, err
 	}
 
 	imgDate := time.Now()
 
-	// Print some info about the message
 	header := mr.Header
 	if date, err := header.Date(); err == nil {
 		imgDate = date
 	}
 
-	if len(e.from) > 0 {
-		// only add images from emails in from whitelist
-		if from, err := header.AddressList("From"); err == nil {
-			found := false
-			for _, good := range e.from {
-				if e.hasAddress(from, good) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return nil, nil
-			}
-		}
+	if !e.since.IsZero() && imgDate.Before(e.since) {
+		// already filtered on the server for IMAP
+		return nil, nil
 	}
+
 	if e.to != "" {
 		if to, err := header.AddressList("To"); err == nil {
 			if !e.hasAddress(to, e.to) {
@@ -160,8 +641,144 @@ func (e *email) getImagesFromEmail(client *client.Client, sequence uint32) ([]*i
 		}
 	}
 
-	// Process each message's part
-	for {
+	var sender *mail.Address
+	if from, err := header.AddressList("From"); err == nil && len(from) > 0 {
+		sender = from[0]
+	}
+
+	held := false
+	if !e.allowed(sender) || !e.verified(raw, header, sender) {
+		if !e.moderate {
+			return nil, nil
+		}
+		held = true
+	}
+
+	images, err := e.imagesFromParts(mr, keyPrefix, imgDate)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range images {
+		img.Held = held
+		if sender == nil {
+			continue
+		}
+		img.Sender = sender.Address
+		if rule := e.sender(sender.Address); rule != nil && rule.caption {
+			img.Caption = sender.Name
+			if img.Caption == "" {
+				img.Caption = sender.Address
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// allowedAddresses are all of the addresses in the from whitelist and sender rules
+func (e *email) allowedAddresses() []string {
+	addresses := append([]string{}, e.from...)
+	for _, s := range e.senders {
+		addresses = append(addresses, s.address)
+	}
+	return addresses
+}
+
+func (e *email) allowed(sender *mail.Address) bool {
+	addresses := e.allowedAddresses()
+	if len(addresses) == 0 {
+		return true
+	}
+	if sender == nil {
+		return false
+	}
+	for _, address := range addresses {
+		if strings.EqualFold(sender.Address, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *email) sender(address string) *emailSender {
+	for i := range e.senders {
+		if strings.EqualFold(e.senders[i].address, address) {
+			return &e.senders[i]
+		}
+	}
+	return nil
+}
+
+// verified checks that the sender's domain has been authenticated either by a valid DKIM signature,
+// or by the topmost Authentication-Results, added by the trusted receiving server.  The From header can be
+// set to anything by anyone, so the whitelist alone isn't enough to keep out spoofed emails
+func (e *email) verified(raw []byte, header mail.Header, sender *mail.Address) bool {
+	if !e.verifyDKIM && e.trustedAuthServer == "" {
+		return true
+	}
+	if sender == nil {
+		return false
+	}
+	domain := strings.ToLower(sender.Address[strings.LastIndex(sender.Address, "@")+1:])
+
+	if e.trustedAuthServer != "" {
+		// only the topmost results were added by the receiving server, the sender can add any below it,
+		// including ones claiming to be from the trusted server
+		identifier, results, err := authres.Parse(header.Get("Authentication-Results"))
+		if err == nil && strings.EqualFold(identifier, e.trustedAuthServer) {
+			for _, result := range results {
+				switch r := result.(type) {
+				case *authres.DMARCResult:
+					if r.Value == authres.ResultPass && domainAligned(r.From, domain) {
+						return true
+					}
+				case *authres.DKIMResult:
+					if r.Value == authres.ResultPass && domainAligned(r.Domain, domain) {
+						return true
+					}
+				case *authres.SPFResult:
+					if r.Value == authres.ResultPass && domainAligned(r.From, domain) {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	if e.verifyDKIM {
+		verifications, err := dkim.Verify(bytes.NewReader(raw))
+		if err != nil {
+			log.Printf("Error verifying DKIM signature from %s: %s\n", sender.Address, err)
+			return false
+		}
+		for _, v := range verifications {
+			if v.Err == nil && domainAligned(v.Domain, domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// domainAligned returns whether an authenticated domain (or email address) is the sender's domain
+// or a parent of it
+func domainAligned(authenticated, domain string) bool {
+	authenticated = strings.ToLower(strings.TrimSpace(authenticated))
+	authenticated = authenticated[strings.LastIndex(authenticated, "@")+1:]
+	if authenticated == "" {
+		return false
+	}
+	return domain == authenticated || strings.HasSuffix(domain, "."+authenticated)
+}
+
+// imagesFromParts processes each of the message's parts, including the parts of any forwarded
+// messages
+func (e *email) imagesFromParts(mr *mail.Reader, keyPrefix string, imgDate time.Time) ([]*image, error) {
+	var images []*image
+
+	for index := 0; ; index++ {
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
@@ -169,45 +786,253 @@ func (e *email) getImagesFromEmail(client *client.Client, sequence uint32) ([]*i
 			return nil, err
 		}
 
-		switch h := p.Header.(type) {
-		case *mail.AttachmentHeader:
-			ctype := p.Header.Get("Content-Type")
-			if strings.Contains(ctype, "image") {
-				split := strings.Split(ctype, ";")
-				if len(split) < 1 {
-					continue
-				}
-				ctype = split[0]
-				filename, _ := h.Filename()
-
-				key := fmt.Sprintf("%s.%d.%s", e.mailbox, msg.Uid, filename)
-				_, err := getImage(key)
-				if err == nil {
-					// image already added
-					continue
-				}
-				if err != bh.ErrNotFound {
-					return nil, err
-				}
+		ctype, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		filename := partFilename(p, params, index)
 
-				body, err := ioutil.ReadAll(p.Body)
-				if err != nil {
-					return nil, err
-				}
+		switch {
+		case ctype == "message/rfc822":
+			forwarded, err := mail.CreateReader(p.Body)
+			if err != nil {
+				return nil, err
+			}
+			forwardedDate := imgDate
+			if date, err := forwarded.Header.Date(); err == nil {
+				forwardedDate = date
+			}
+			imgs, err := e.imagesFromParts(forwarded, fmt.Sprintf("%s.%d", keyPrefix, index),
+				forwardedDate)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, imgs...)
+		case ctype == "text/html" && e.linkedImages:
+			imgs, err := e.imagesFromHTML(p.Body, imgDate)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, imgs...)
+		default:
+			ctype = mediaContentType(ctype, filename)
+			if ctype == "" {
+				continue
+			}
+
+			key := fmt.Sprintf("%s.%s", keyPrefix, filename)
+			_, err := getImage(key)
+			if err == nil {
+				// image already added
+				continue
+			}
+			if err != bh.ErrNotFound {
+				return nil, err
+			}
 
-				images = append(images, &image{
-					Key:         key,
-					Date:        imgDate,
-					Data:        body,
-					Provider:    e.name(),
-					ContentType: ctype,
-				})
+			body, err := ioutil.ReadAll(io.LimitReader(p.Body, maxVideoSize+1))
+			if err != nil {
+				return nil, err
 			}
+
+			if len(body) > maxVideoSize {
+				// only short clips are shown
+				continue
+			}
+
+			if _, ok := p.Header.(*mail.InlineHeader); ok && len(body) < emailMinInlineSize {
+				// most likely a logo or icon in a signature
+				continue
+			}
+
+			images = append(images, &image{
+				Key:         key,
+				Date:        imgDate,
+				Data:        body,
+				Provider:    e.name(),
+				ContentType: ctype,
+			})
+		}
+	}
+	return pairLivePhotos(images), nil
+}
+
+// pairLivePhotos shows each Live Photo, sent as a still and a motion part with the same name, as its
+// motion part alone.  The motion part is placed where the still was taken, since only the still's
+// EXIF data is read
+func pairLivePhotos(images []*image) []*image {
+	stills := make(map[string]*image)
+	for _, img := range images {
+		if !strings.HasPrefix(img.ContentType, "video/") {
+			stills[livePhotoName(img.Key)] = img
+		}
+	}
+
+	paired := make(map[*image]bool)
+	for _, img := range images {
+		still, ok := stills[livePhotoName(img.Key)]
+		if !ok || !strings.HasPrefix(img.ContentType, "video/") {
+			continue
+		}
+		if err := img.locate(still.Data); err != nil {
+			log.Printf("Error locating %s: %s\n", img.Key, err)
+		}
+		paired[still] = true
+	}
+
+	if len(paired) == 0 {
+		return images
+	}
+	motion := images[:0]
+	for _, img := range images {
+		if !paired[img] {
+			motion = append(motion, img)
 		}
 	}
+	return motion
+}
+
+// livePhotoName is the name the still and motion part of a Live Photo share, i.e. IMG_1234 for
+// IMG_1234.HEIC and IMG_1234.MOV
+func livePhotoName(key string) string {
+	return strings.ToLower(strings.TrimSuffix(key, path.Ext(key)))
+}
+
+// imagesFromHTML downloads the images linked or embedded by url in an html email body
+func (e *email) imagesFromHTML(r io.Reader, imgDate time.Time) ([]*image, error) {
+	var images []*image
+	z := nethtml.NewTokenizer(r)
+	for len(images) < maxImagesPerPoll {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			if z.Err() == io.EOF {
+				break
+			}
+			return nil, z.Err()
+		}
+		if tt != nethtml.StartTagToken && tt != nethtml.SelfClosingTagToken {
+			continue
+		}
+
+		token := z.Token()
+		var link string
+		for _, attr := range token.Attr {
+			if (token.Data == "img" && attr.Key == "src") ||
+				(token.Data == "a" && attr.Key == "href" &&
+					strings.HasPrefix(mediaContentType("", attr.Val), "image/")) {
+				link = attr.Val
+			}
+		}
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			// cid: images are included as inline parts
+			continue
+		}
+
+		img, err := e.downloadImage(link, imgDate)
+		if err != nil {
+			// a dead link shouldn't keep the rest of the mailbox from being imported
+			log.Printf("Error downloading linked email image %s: %s\n", link, err)
+			continue
+		}
+		if img != nil {
+			images = append(images, img)
+		}
+	}
+
 	return images, nil
 }
 
+func (e *email) downloadImage(link string, imgDate time.Time) (*image, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkLink(u); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%s.link.%x", e.name(), sha256.Sum256([]byte(link)))
+	// images linked before keys were namespaced are keyed by their url
+	for _, k := range []string{key, link} {
+		_, err = getImage(k)
+		if err == nil {
+			// image already added
+			return nil, nil
+		}
+		if err != bh.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	resp, err := emailLinkClient.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	ctype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(ctype, "image/") {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxVideoSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) < emailMinInlineSize || len(body) > maxVideoSize {
+		// tracking pixels and logos, or something too large to be a photo
+		return nil, nil
+	}
+
+	return &image{
+		Key:         key,
+		Date:        imgDate,
+		Data:        body,
+		Provider:    e.name(),
+		ContentType: ctype,
+	}, nil
+}
+
+// partFilename returns the best name available for a message part, falling back to the part's
+// index in the message
+func partFilename(p *mail.Part, ctypeParams map[string]string, index int) string {
+	if h, ok := p.Header.(*mail.AttachmentHeader); ok {
+		if filename, err := h.Filename(); err == nil && filename != "" {
+			return filename
+		}
+	}
+
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if params["filename"] != "" {
+		return params["filename"]
+	}
+	if ctypeParams["name"] != "" {
+		return ctypeParams["name"]
+	}
+	if id := strings.Trim(p.Header.Get("Content-ID"), "<>"); id != "" {
+		return id
+	}
+	return strconv.Itoa(index)
+}
+
+// mediaContentType returns the image or video content type of a part, using the filename's
+// extension for parts sent with a generic content type, or an empty string if the part is neither
+func mediaContentType(ctype, filename string) string {
+	if strings.HasPrefix(ctype, "image/") || strings.HasPrefix(ctype, "video/") {
+		return ctype
+	}
+	if ctype != "" && ctype != "application/octet-stream" {
+		return ""
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	if i := strings.IndexAny(ext, "?#"); i != -1 {
+		ext = ext[:i]
+	}
+	return mediaExtensions[ext]
+}
+
 func (e *email) hasAddress(addresses []*mail.Address, address string) bool {
 	for _, addr := range addresses {
 		a := addr.String()
@@ -0,0 +1,248 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"go.etcd.io/bbolt"
+)
+
+// event is a group of images taken close together in time and place, like a day out or a holiday
+type event struct {
+	Key      string `boltholdKey:"Key"`
+	Start    time.Time
+	End      time.Time
+	Location *geoPoint // where the first located image in it was taken
+	Place    string
+}
+
+// near returns whether a point is close enough to the event to be part of it, images which weren't
+// located are near every event
+func (e *event) near(point *geoPoint) bool {
+	if e.Location == nil || point == nil {
+		return true
+	}
+	return distance(*e.Location, *point) <= viper.GetFloat64("eventDistance")
+}
+
+// apart returns how long before or after the event a time is, 0 during it
+func (e *event) apart(t time.Time) time.Duration {
+	if t.Before(e.Start) {
+		return e.Start.Sub(t)
+	}
+	if t.After(e.End) {
+		return t.Sub(e.End)
+	}
+	return 0
+}
+
+// include extends the event to include an image
+func (e *event) include(img *image) {
+	if img.Date.Before(e.Start) {
+		e.Start = img.Date
+	}
+	if img.Date.After(e.End) {
+		e.End = img.Date
+	}
+	if e.Location == nil {
+		e.Location = img.Location
+	}
+	if e.Place == "" {
+		e.Place = img.Place
+	}
+}
+
+func newEvent(img *image) (*event, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &event{Key: fmt.Sprintf("event:%x", id), Start: img.Date, End: img.Date}, nil
+}
+
+// assignEvent adds an image to the event it was taken during, within eventGap of the event's other
+// images and eventDistance of where it was, starting a new event if there isn't one.  Events the image
+// bridges the gap between are merged, as long as they were near each other
+func assignEvent(tx *bbolt.Tx, img *image) error {
+	gap := viper.GetDuration("eventGap")
+	var candidates []event
+	err := store.TxFind(tx, &candidates, bh.Where("End").Ge(img.Date.Add(-gap)).And("Start").Le(img.Date.Add(gap)))
+	if err != nil {
+		return err
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].apart(img.Date) < candidates[j].apart(img.Date)
+	})
+
+	var joined *event
+	for i := range candidates {
+		if !candidates[i].near(img.Location) {
+			continue
+		}
+		if joined == nil {
+			joined = &candidates[i]
+			continue
+		}
+		// images which weren't located don't join events in different places
+		if !candidates[i].near(joined.Location) {
+			continue
+		}
+		if err = mergeEvents(tx, joined, &candidates[i]); err != nil {
+			return err
+		}
+	}
+	if joined == nil {
+		if joined, err = newEvent(img); err != nil {
+			return err
+		}
+	}
+
+	joined.include(img)
+	img.Event = joined.Key
+	return store.TxUpsert(tx, joined.Key, joined)
+}
+
+// mergeEvents moves the images of an event into another, and removes it
+func mergeEvents(tx *bbolt.Tx, into, from *event) error {
+	err := store.TxUpdateMatching(tx, &image{}, bh.Where("Event").Eq(from.Key), func(record interface{}) error {
+		record.(*image).Event = into.Key
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if from.Start.Before(into.Start) {
+		into.Start = from.Start
+	}
+	if from.End.After(into.End) {
+		into.End = from.End
+	}
+	if into.Location == nil {
+		into.Location = from.Location
+	}
+	if into.Place == "" {
+		into.Place = from.Place
+	}
+	return store.TxDelete(tx, from.Key, &event{})
+}
+
+// groupStoredImages assigns events to images stored before images were grouped, in the order they were
+// taken, and removes events whose images have all been removed
+func groupStoredImages() {
+	type ungrouped struct {
+		key  string
+		date time.Time
+	}
+	var images []ungrouped
+	err := store.ForEach(bh.Where("Event").Eq(""), func(img *image) error {
+		images = append(images, ungrouped{key: img.Key, date: img.Date})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error finding images to group into events: %s\n", err)
+		return
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].date.Before(images[j].date) })
+
+	for _, u := range images {
+		err = store.Bolt().Update(func(tx *bbolt.Tx) error {
+			img := &image{}
+			err := store.TxGet(tx, u.key, img)
+			if err != nil {
+				return err
+			}
+			if err = assignEvent(tx, img); err != nil {
+				return err
+			}
+			return store.TxUpdate(tx, img.Key, img)
+		})
+		if err != nil {
+			log.Printf("Error grouping %s into an event: %s\n", u.key, err)
+		}
+	}
+
+	var events []event
+	err = store.Find(&events, nil)
+	if err != nil {
+		log.Printf("Error getting events: %s\n", err)
+		return
+	}
+	for i := range events {
+		count, err := store.Count(&image{}, bh.Where("Event").Eq(events[i].Key))
+		if err == nil && count == 0 {
+			err = store.Delete(events[i].Key, &event{})
+		}
+		if err != nil {
+			log.Printf("Error removing empty event %s: %s\n", events[i].Key, err)
+		}
+	}
+}
+
+// randomEvent returns a random event with images to show, other than the previous one unless it's the
+// only one, or an empty string if images haven't been grouped into events
+func randomEvent(previous string) string {
+	// every event with images to show, found in one pass over the images
+	shown := make(map[string]bool)
+	err := store.ForEach(queuedImages(), func(img *image) error {
+		if img.Event != "" {
+			shown[img.Event] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error finding events to show: %s\n", err)
+		return ""
+	}
+
+	events := make([]string, 0, len(shown))
+	for key := range shown {
+		if key != previous {
+			events = append(events, key)
+		}
+	}
+	if len(events) == 0 {
+		if shown[previous] {
+			return previous
+		}
+		return ""
+	}
+	return events[mathrand.Intn(len(events))]
+}
+
+// titleCard introduces an event in story mode
+type titleCard struct {
+	Place string
+	Dates string
+}
+
+// eventTitle returns the title card of an event
+func eventTitle(key string) (*titleCard, error) {
+	e := &event{}
+	err := store.Get(key, e)
+	if err != nil {
+		return nil, err
+	}
+	return &titleCard{Place: e.Place, Dates: dateRange(e.Start, e.End)}, nil
+}
+
+// dateRange returns the days from start to end, leaving out what they share, i.e. 3 - 7 April 2019
+func dateRange(start, end time.Time) string {
+	switch {
+	case start.Year() != end.Year():
+		return start.Format("2 January 2006") + " – " + end.Format("2 January 2006")
+	case start.Month() != end.Month():
+		return start.Format("2 January") + " – " + end.Format("2 January 2006")
+	case start.Day() != end.Day():
+		return start.Format("2") + " – " + end.Format("2 January 2006")
+	}
+	return start.Format("2 January 2006")
+}
@@ -0,0 +1,377 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	goimage "image"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+)
+
+const (
+	faceDetectSize    = 800 // images are scaled down to this before looking for faces in them
+	faceMinSize       = 20  // the smallest face found, in pixels of the scaled image
+	faceShift         = 0.1 // how far the search window moves, as a fraction of its size
+	faceScale         = 1.1 // how much the search window grows each pass
+	faceOverlap       = 0.2 // detections overlapping more than this are the same face
+	faceThumbnailPad  = 0.3 // how much of the surroundings is shown around a face's thumbnail
+	faceThumbnailSize = 160
+)
+
+// face is where a face was found in an image, as fractions of the displayed image's size
+type face struct {
+	X       float64 // left
+	Y       float64 // top
+	Width   float64
+	Height  float64
+	Quality float64
+	Person  string // who it is, once an admin has named them
+}
+
+// faceCascade is a pico face detection cascade, a set of decision trees comparing the brightness of
+// pairs of pixels, which needs no more than a grayscale image and a CPU.
+// See https://arxiv.org/abs/1305.4537
+type faceCascade struct {
+	depth      int
+	codes      []int8
+	predicts   []float32
+	thresholds []float32
+}
+
+var peopleTemplate = template.Must(template.New("").Parse(peoplePage))
+
+var detector = struct {
+	sync.Once
+	cascade *faceCascade
+	err     error
+}{}
+
+// faceDetector returns the cascade configured in faces.cascade, nil if faces aren't detected
+func faceDetector() (*faceCascade, error) {
+	detector.Do(func() {
+		file := viper.GetString("faces.cascade")
+		if file == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			detector.err = err
+			return
+		}
+		detector.cascade, detector.err = unpackCascade(data)
+	})
+	return detector.cascade, detector.err
+}
+
+// unpackCascade reads a cascade in pico's binary format
+func unpackCascade(data []byte) (*faceCascade, error) {
+	invalid := fmt.Errorf("Invalid face detection cascade")
+	// the first 8 bytes are unused
+	if len(data) < 16 {
+		return nil, invalid
+	}
+	c := &faceCascade{depth: int(int32(binary.LittleEndian.Uint32(data[8:])))}
+	trees := int(int32(binary.LittleEndian.Uint32(data[12:])))
+	if c.depth < 1 || c.depth > 16 || trees < 1 {
+		return nil, invalid
+	}
+
+	leaves := 1 << uint(c.depth)
+	pos := 16
+	for t := 0; t < trees; t++ {
+		if len(data) < pos+4*(leaves-1)+4*leaves+4 {
+			return nil, invalid
+		}
+		// trees are indexed from 1, so each starts with an unused node
+		c.codes = append(c.codes, 0, 0, 0, 0)
+		for _, b := range data[pos : pos+4*(leaves-1)] {
+			c.codes = append(c.codes, int8(b))
+		}
+		pos += 4 * (leaves - 1)
+		for i := 0; i < leaves; i++ {
+			c.predicts = append(c.predicts, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		}
+		c.thresholds = append(c.thresholds, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+		pos += 4
+	}
+	return c, nil
+}
+
+// classify returns how sure the cascade is that there's a face of size centered on row and col of a
+// grayscale image, or -1 if there isn't one
+func (c *faceCascade) classify(row, col, size int, pixels []uint8, stride int) float32 {
+	leaves := 1 << uint(c.depth)
+	row, col = row*256, col*256
+	root := 0
+	var out float32
+	for t := range c.thresholds {
+		i := 1
+		for d := 0; d < c.depth; d++ {
+			code := c.codes[root+4*i:]
+			p1 := ((row+int(code[0])*size)>>8)*stride + ((col + int(code[1])*size) >> 8)
+			p2 := ((row+int(code[2])*size)>>8)*stride + ((col + int(code[3])*size) >> 8)
+			i *= 2
+			if pixels[p1] <= pixels[p2] {
+				i++
+			}
+		}
+		out += c.predicts[leaves*t+i-leaves]
+		if out <= c.thresholds[t] {
+			return -1
+		}
+		root += 4 * leaves
+	}
+	return out - c.thresholds[len(c.thresholds)-1]
+}
+
+// detection is a square window the cascade found a face in
+type detection struct {
+	row, col, size int
+	quality        float64
+}
+
+// detect returns the faces in an image, scanning it with windows of every size
+func (c *faceCascade) detect(src goimage.Image) []face {
+	b := src.Bounds()
+	scale := math.Min(1, faceDetectSize/math.Max(float64(b.Dx()), float64(b.Dy())))
+	gray := goimage.NewGray(goimage.Rect(0, 0, maxInt(1, int(float64(b.Dx())*scale)), maxInt(1, int(float64(b.Dy())*scale))))
+	draw.ApproxBiLinear.Scale(gray, gray.Bounds(), src, b, draw.Src, nil)
+	rows, cols := gray.Rect.Dy(), gray.Rect.Dx()
+
+	var found []detection
+	for size := faceMinSize; size <= minInt(rows, cols); size = int(float64(size) * faceScale) {
+		step := maxInt(1, int(faceShift*float64(size)))
+		offset := size/2 + 1
+		for row := offset; row <= rows-offset; row += step {
+			for col := offset; col <= cols-offset; col += step {
+				if q := c.classify(row, col, size, gray.Pix, gray.Stride); q > 0 {
+					found = append(found, detection{row: row, col: col, size: size, quality: float64(q)})
+				}
+			}
+		}
+	}
+
+	minQuality := viper.GetFloat64("faces.minQuality")
+	var faces []face
+	for _, d := range clusterDetections(found) {
+		if d.quality < minQuality {
+			continue
+		}
+		faces = append(faces, face{
+			X:       float64(d.col-d.size/2) / float64(cols),
+			Y:       float64(d.row-d.size/2) / float64(rows),
+			Width:   float64(d.size) / float64(cols),
+			Height:  float64(d.size) / float64(rows),
+			Quality: d.quality,
+		})
+	}
+	return faces
+}
+
+// clusterDetections merges the overlapping windows a face is found in, the more windows a face is found
+// in, the higher the quality of the detection
+func clusterDetections(found []detection) []detection {
+	merged := make([]bool, len(found))
+	var faces []detection
+	for i := range found {
+		if merged[i] {
+			continue
+		}
+		var row, col, size, n int
+		var quality float64
+		for j := range found {
+			if !merged[j] && overlap(found[i], found[j]) > faceOverlap {
+				merged[j] = true
+				row, col, size = row+found[j].row, col+found[j].col, size+found[j].size
+				quality += found[j].quality
+				n++
+			}
+		}
+		faces = append(faces, detection{row: row / n, col: col / n, size: size / n, quality: quality})
+	}
+	return faces
+}
+
+// overlap returns the intersection over union of two detections
+func overlap(a, b detection) float64 {
+	rows := maxInt(0, minInt(a.row+a.size/2, b.row+b.size/2)-maxInt(a.row-a.size/2, b.row-b.size/2))
+	cols := maxInt(0, minInt(a.col+a.size/2, b.col+b.size/2)-maxInt(a.col-a.size/2, b.col-b.size/2))
+	intersection := float64(rows * cols)
+	return intersection / (float64(a.size*a.size+b.size*b.size) - intersection)
+}
+
+// detectFaces finds the faces in an image if they haven't been looked for, and centers its crops and
+// zooms on them
+func (i *image) detectFaces() error {
+	if i.FacesDetected || !i.hasVariants() {
+		return nil
+	}
+	cascade, err := faceDetector()
+	if err != nil || cascade == nil {
+		return err
+	}
+
+	src, _, err := goimage.Decode(bytes.NewReader(i.Data))
+	if err != nil {
+		// not tried again
+		i.FacesDetected = true
+		return err
+	}
+	// faces are found in the image as it's displayed, so their positions line up with it
+	i.Faces = cascade.detect(orient(scaleDown(src, faceDetectSize), exifOrientation(i.Data)))
+	i.FacesDetected = true
+	// images without faces keep the focus on their most detailed part
+	if focus := facesFocus(i.Faces); focus != nil {
+		i.Focus = focus
+	}
+	return nil
+}
+
+// scaleDown returns an image no larger than size on either side
+func scaleDown(src goimage.Image, size int) goimage.Image {
+	b := src.Bounds()
+	scale := float64(size) / math.Max(float64(b.Dx()), float64(b.Dy()))
+	if scale >= 1 {
+		return src
+	}
+	dst := goimage.NewRGBA(goimage.Rect(0, 0, maxInt(1, int(float64(b.Dx())*scale)), maxInt(1, int(float64(b.Dy())*scale))))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// facesFocus returns the center of the area the faces in an image are in, nil if there are none
+func facesFocus(faces []face) *focalPoint {
+	if len(faces) == 0 {
+		return nil
+	}
+	left, top, right, bottom := 1.0, 1.0, 0.0, 0.0
+	for _, f := range faces {
+		left, top = math.Min(left, f.X), math.Min(top, f.Y)
+		right, bottom = math.Max(right, f.X+f.Width), math.Max(bottom, f.Y+f.Height)
+	}
+	return &focalPoint{X: (left + right) / 2, Y: (top + bottom) / 2}
+}
+
+// detectStoredFaces looks for faces in images stored before they were looked for, or before faces
+// were configured
+func detectStoredFaces() {
+	cascade, err := faceDetector()
+	if err != nil {
+		log.Printf("Error loading face detection cascade: %s\n", err)
+		return
+	}
+	if cascade == nil {
+		return
+	}
+
+	keys, err := imageKeys(bh.Where("FacesDetected").Eq(false).And("Kind").Eq(kindImage))
+	if err != nil {
+		log.Printf("Error finding images to detect faces in: %s\n", err)
+		return
+	}
+	for _, key := range keys {
+		err = updateImage(key, func(img *image) {
+			if err := img.detectFaces(); err != nil {
+				log.Printf("Error detecting faces in %s: %s\n", img.Key, err)
+			}
+		})
+		if err != nil {
+			log.Printf("Error storing faces of %s: %s\n", key, err)
+			continue
+		}
+		// cropped variants are centered on the faces now
+		err = store.Bolt().Update(func(tx *bbolt.Tx) error {
+			return txDeleteVariants(tx, key)
+		})
+		if err != nil {
+			log.Printf("Error removing variants of %s: %s\n", key, err)
+		}
+	}
+}
+
+// nameFace sets who the face at index in an image is, an empty name clears it
+func (i *image) nameFace(index int, name string) {
+	i.Faces[index].Person = strings.TrimSpace(name)
+
+	people := make(map[string]bool)
+	i.People = nil
+	for _, f := range i.Faces {
+		if f.Person != "" && !people[f.Person] {
+			people[f.Person] = true
+			i.People = append(i.People, f.Person)
+		}
+	}
+	sort.Strings(i.People)
+}
+
+// faceInfo is a face found in an image, as listed for naming
+type faceInfo struct {
+	Key     string  `json:"key"`
+	Index   int     `json:"index"`
+	Person  string  `json:"person,omitempty"`
+	Quality float64 `json:"quality"`
+}
+
+// getFaces returns every face found, unnamed faces first
+func getFaces() ([]faceInfo, error) {
+	var faces []faceInfo
+	err := store.ForEach(bh.Where("FacesDetected").Eq(true), func(img *image) error {
+		for i, f := range img.Faces {
+			faces = append(faces, faceInfo{Key: img.Key, Index: i, Person: f.Person, Quality: f.Quality})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(faces, func(i, j int) bool {
+		if faces[i].Person != faces[j].Person {
+			return faces[i].Person < faces[j].Person
+		}
+		return faces[i].Quality > faces[j].Quality
+	})
+	return faces, nil
+}
+
+// faceThumbnail returns a jpeg of the face at index in an image, with some of its surroundings
+func faceThumbnail(img *image, index int, size int) ([]byte, error) {
+	if index < 0 || index >= len(img.Faces) {
+		return nil, fmt.Errorf("Invalid face %d", index)
+	}
+	src, _, err := goimage.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, err
+	}
+	src = orient(scaleDown(src, faceDetectSize), exifOrientation(img.Data))
+
+	b := src.Bounds()
+	f := img.Faces[index]
+	crop := goimage.Rect(
+		b.Min.X+int((f.X-f.Width*faceThumbnailPad)*float64(b.Dx())),
+		b.Min.Y+int((f.Y-f.Height*faceThumbnailPad)*float64(b.Dy())),
+		b.Min.X+int((f.X+f.Width*(1+faceThumbnailPad))*float64(b.Dx())),
+		b.Min.Y+int((f.Y+f.Height*(1+faceThumbnailPad))*float64(b.Dy())),
+	).Intersect(b)
+	if crop.Empty() {
+		return nil, fmt.Errorf("Invalid face %d", index)
+	}
+
+	dst := goimage.NewRGBA(goimage.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return encodeJPEG(dst)
+}
@@ -0,0 +1,511 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	goimage "image"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+)
+
+// fit modes, how an image fills its part of the screen
+const (
+	fitContain = "contain" // the whole image, with black bars
+	fitCover   = "cover"   // cropped to fill, keeping the faces or most detailed part of the image
+	fitBlur    = "blur"    // the whole image, over a blurred copy of it instead of black bars
+)
+
+const (
+	fitCookie    = "fit"
+	screenCookie = "screen" // set by the display's page to its size in device pixels
+
+	maxVariantSize = 4096 // the largest width or height a variant is rendered at
+	saliencySize   = 128  // the size detail is measured at when choosing a crop
+	blurScale      = 16   // blurred backgrounds are rendered at a sixteenth of the size they're shown at
+	variantShapes  = 16   // the shapes variants are rendered in, as sixteenths of their longest side
+)
+
+// variantSteps are the lengths the longest side of a variant is rounded up to, so that displays of
+// slightly different sizes share variants, and there's only a few variants of each image however many
+// sizes they're asked for at
+var variantSteps = []int{480, 720, 1080, 1440, 2160, 2880, maxVariantSize}
+
+func validFit(name string) bool {
+	switch name {
+	case fitContain, fitCover, fitBlur:
+		return true
+	}
+	return false
+}
+
+// frameFit returns the fit mode for a frame, which can be chosen for each frame by opening it once
+// with the fit query parameter
+func frameFit(w http.ResponseWriter, r *http.Request) string {
+	if name := r.URL.Query().Get("fit"); validFit(name) {
+		http.SetCookie(w, &http.Cookie{
+			Name:    fitCookie,
+			Value:   name,
+			Path:    "/",
+			Expires: time.Now().AddDate(10, 0, 0),
+		})
+		return name
+	}
+	if cookie, err := r.Cookie(fitCookie); err == nil && validFit(cookie.Value) {
+		return cookie.Value
+	}
+	return viper.GetString("fit")
+}
+
+// displaySize returns the size of the display making the request, if it's known
+func displaySize(r *http.Request) (int, int, bool) {
+	cookie, err := r.Cookie(screenCookie)
+	if err != nil {
+		return 0, 0, false
+	}
+	return parseDisplaySize(cookie.Value)
+}
+
+// parseDisplaySize parses a WIDTHxHEIGHT size, limiting it to the largest variant size
+func parseDisplaySize(value string) (int, int, bool) {
+	parts := strings.Split(value, "x")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 {
+		return 0, 0, false
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height <= 0 {
+		return 0, 0, false
+	}
+	if width > maxVariantSize || height > maxVariantSize {
+		scale := float64(maxVariantSize) / math.Max(float64(width), float64(height))
+		width = maxInt(1, int(float64(width)*scale))
+		height = maxInt(1, int(float64(height)*scale))
+	}
+	return width, height, true
+}
+
+// variantSize rounds a size up to the nearest of the sizes variants are rendered at, keeping close to
+// its shape.  Displays show variants cropped to fill their part of the screen, so the little that's
+// cropped by a difference in shape isn't noticed
+func variantSize(width, height int) (int, int) {
+	long, short := width, height
+	if height > width {
+		long, short = height, width
+	}
+	step := maxVariantSize
+	for _, s := range variantSteps {
+		if s >= long {
+			step = s
+			break
+		}
+	}
+	shape := maxInt(1, int(math.Round(float64(short)*variantShapes/float64(long))))
+	short = step * shape / variantShapes
+	if height > width {
+		return short, step
+	}
+	return step, short
+}
+
+// hasVariants returns whether an image can be rendered for a fit mode, animated gifs would stop moving
+func (i *image) hasVariants() bool {
+	return !i.isVideo() && i.ContentType != "image/gif"
+}
+
+// imageURL returns where to load an image fitted to a part of a display of width by height pixels
+func imageURL(img *image, fit string, width, height int) string {
+	values := url.Values{"key": {img.Key}}
+	if fit != fitContain && img.hasVariants() && width > 0 && height > 0 {
+		values.Set("fit", fit)
+		values.Set("size", fmt.Sprintf("%dx%d", width, height))
+	}
+	return "/image?" + values.Encode()
+}
+
+// variant is an image rendered for a fit mode and size, kept since rendering it is slow
+type variant struct {
+	Key   string `boltholdKey:"Key"`
+	Image string `boltholdIndex:"Image"`
+	Data  []byte
+}
+
+// imageVariant returns the image rendered to fill width by height pixels with a fit mode, rendering
+// and storing it the first time it's asked for
+func imageVariant(img *image, fit string, width, height int) ([]byte, error) {
+	width, height = variantSize(width, height)
+	key := fmt.Sprintf("%s|%s|%dx%d", img.Key, fit, width, height)
+	v := &variant{}
+	err := store.Get(key, v)
+	if err == nil {
+		return v.Data, nil
+	}
+	if err != bh.ErrNotFound {
+		return nil, err
+	}
+
+	src, _, err := goimage.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, err
+	}
+	src = orient(src, exifOrientation(img.Data))
+
+	var dst goimage.Image
+	switch fit {
+	case fitCover:
+		dst = cover(src, img.Focus, width, height)
+	case fitBlur:
+		dst = blurFill(src, width, height)
+	default:
+		return nil, fmt.Errorf("Invalid fit %s", fit)
+	}
+
+	data, err := encodeJPEG(dst)
+	if err != nil {
+		return nil, err
+	}
+	err = store.Bolt().Update(func(tx *bbolt.Tx) error {
+		return txStoreVariant(tx, &variant{Key: key, Image: img.Key, Data: data})
+	})
+	if err != nil {
+		log.Printf("Error storing %s variant of %s: %s\n", fit, img.Key, err)
+	}
+	return data, nil
+}
+
+// txStoreVariant stores a variant, counting its size in what its image uses of the storage budget
+func txStoreVariant(tx *bbolt.Tx, v *variant) error {
+	err := store.TxGet(tx, v.Key, &variant{})
+	if err == nil {
+		// rendered at the same time for another display
+		return nil
+	}
+	if err != bh.ErrNotFound {
+		return err
+	}
+	s := &stored{}
+	err = store.TxGet(tx, v.Image, s)
+	if err == bh.ErrNotFound {
+		// the image was removed while the variant was rendered
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.Variants += int64(len(v.Data))
+	err = store.TxUpdate(tx, s.Key, s)
+	if err != nil {
+		return err
+	}
+	return store.TxInsert(tx, v.Key, v)
+}
+
+// txDeleteVariants removes the variants of an image, so they're rendered again the next time they're
+// asked for
+func txDeleteVariants(tx *bbolt.Tx, key string) error {
+	err := store.TxDeleteMatching(tx, &variant{}, bh.Where("Image").Eq(key))
+	if err != nil {
+		return err
+	}
+	s := &stored{}
+	err = store.TxGet(tx, key, s)
+	if err == bh.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.Variants = 0
+	return store.TxUpdate(tx, key, s)
+}
+
+// orient turns an image the way its EXIF orientation says it's displayed, since the orientation is
+// lost when it's rendered again
+func orient(src goimage.Image, orientation int) goimage.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	dst := goimage.NewRGBA(goimage.Rect(0, 0, width, height))
+	if orientation >= 5 {
+		dst = goimage.NewRGBA(goimage.Rect(0, 0, height, width))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2: // mirrored
+				dx = width - 1 - x
+			case 3: // upside down
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored upside down
+				dy = height - 1 - y
+			case 5: // mirrored and turned left
+				dx, dy = y, x
+			case 6: // turned right
+				dx, dy = height-1-y, x
+			case 7: // mirrored and turned right
+				dx, dy = height-1-y, width-1-x
+			case 8: // turned left
+				dx, dy = y, width-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// cover crops an image to the shape of width by height, around its focal point if it has one, or
+// else its most detailed part, and scales it down to that size
+func cover(src goimage.Image, focus *focalPoint, width, height int) goimage.Image {
+	b := src.Bounds()
+	var crop goimage.Rectangle
+	cropWidth, cropHeight := coverSize(b, width, height)
+	if focus != nil {
+		crop = focusCrop(b, focus, cropWidth, cropHeight)
+	} else {
+		crop = salientCrop(src, cropWidth, cropHeight)
+	}
+
+	// the browser scales small images up just as well
+	if crop.Dx() < width {
+		width, height = crop.Dx(), crop.Dy()
+	}
+	dst := goimage.NewRGBA(goimage.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// coverSize returns the largest size with the shape of width by height which fits in bounds
+func coverSize(bounds goimage.Rectangle, width, height int) (int, int) {
+	cropWidth, cropHeight := bounds.Dx(), bounds.Dx()*height/width
+	if cropHeight > bounds.Dy() {
+		cropWidth, cropHeight = bounds.Dy()*width/height, bounds.Dy()
+	}
+	return maxInt(1, cropWidth), maxInt(1, cropHeight)
+}
+
+// focusCrop returns the crop of the passed in size centered as close as it can be on a focal point
+func focusCrop(bounds goimage.Rectangle, focus *focalPoint, width, height int) goimage.Rectangle {
+	x := bounds.Min.X + int(focus.X*float64(bounds.Dx())) - width/2
+	y := bounds.Min.Y + int(focus.Y*float64(bounds.Dy())) - height/2
+	x = minInt(maxInt(x, bounds.Min.X), bounds.Max.X-width)
+	y = minInt(maxInt(y, bounds.Min.Y), bounds.Max.Y-height)
+	return goimage.Rect(x, y, x+width, y+height)
+}
+
+// salientCrop returns the crop of the passed in size with the most detail in it, which is where the
+// subject of a photo usually is, rather than the sky or a blurred background
+func salientCrop(src goimage.Image, width, height int) goimage.Rectangle {
+	b := src.Bounds()
+	horizontal := width < b.Dx()
+	if !horizontal && height >= b.Dy() {
+		return b
+	}
+
+	columns, rows, scale := detailProfile(src)
+	detail, window := rows, int(float64(height)*scale)
+	if horizontal {
+		detail, window = columns, int(float64(width)*scale)
+	}
+	window = minInt(maxInt(window, 1), len(detail))
+
+	offset := int(float64(bestWindow(detail, window)) / scale)
+	if horizontal {
+		x := minInt(b.Min.X+offset, b.Max.X-width)
+		return goimage.Rect(x, b.Min.Y, x+width, b.Min.Y+height)
+	}
+	y := minInt(b.Min.Y+offset, b.Max.Y-height)
+	return goimage.Rect(b.Min.X, y, b.Min.X+width, y+height)
+}
+
+// salientFocus returns the middle of the most detailed part of an image, for pans and zooms to center on
+// when there are no faces in it
+func salientFocus(src goimage.Image) *focalPoint {
+	columns, rows, _ := detailProfile(src)
+	middle := func(detail []float64) float64 {
+		window := maxInt(1, len(detail)/2)
+		return (float64(bestWindow(detail, window)) + float64(window)/2) / float64(len(detail))
+	}
+	return &focalPoint{X: middle(columns), Y: middle(rows)}
+}
+
+// detailProfile returns how much detail is in each column and row of a small grayscale copy of an
+// image, measured as the difference between neighbouring pixels, and the scale of the copy
+func detailProfile(src goimage.Image) (columns, rows []float64, scale float64) {
+	b := src.Bounds()
+	scale = float64(saliencySize) / math.Max(float64(b.Dx()), float64(b.Dy()))
+	small := goimage.NewGray(goimage.Rect(0, 0, maxInt(2, int(float64(b.Dx())*scale)),
+		maxInt(2, int(float64(b.Dy())*scale))))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), src, b, draw.Src, nil)
+	sb := small.Bounds()
+
+	columns, rows = make([]float64, sb.Dx()), make([]float64, sb.Dy())
+	for y := 0; y < sb.Dy()-1; y++ {
+		for x := 0; x < sb.Dx()-1; x++ {
+			p := float64(small.GrayAt(x, y).Y)
+			d := math.Abs(float64(small.GrayAt(x+1, y).Y)-p) + math.Abs(float64(small.GrayAt(x, y+1).Y)-p)
+			columns[x] += d
+			rows[y] += d
+		}
+	}
+	return columns, rows, scale
+}
+
+// bestWindow returns where the window of the passed in length with the most detail in it starts
+func bestWindow(detail []float64, window int) int {
+	length := len(detail)
+	sum := 0.0
+	for i := 0; i < window; i++ {
+		sum += detail[i]
+	}
+	center := float64(length-window) / 2
+	best, bestScore := 0, -1.0
+	for start := 0; start+window <= length; start++ {
+		if start > 0 {
+			sum += detail[start+window-1] - detail[start-1]
+		}
+		// photos are usually framed around their subject, so windows further from the center need more
+		// detail to be chosen
+		score := sum
+		if center > 0 {
+			score *= 1 - 0.25*math.Abs(float64(start)-center)/center
+		}
+		// featureless images are centered
+		nearer := math.Abs(float64(start)-center) < math.Abs(float64(best)-center)
+		if score > bestScore || (score == bestScore && nearer) {
+			best, bestScore = start, score
+		}
+	}
+	return best
+}
+
+// findFocus sets what pans and zooms of an image center on to its most detailed part, if it hasn't
+// been set to its faces
+func (i *image) findFocus() error {
+	if i.Focused || !i.hasVariants() {
+		return nil
+	}
+	i.Focused = true
+	if i.Focus != nil {
+		return nil
+	}
+	src, _, err := goimage.Decode(bytes.NewReader(i.Data))
+	if err != nil {
+		return err
+	}
+	i.Focus = salientFocus(orient(scaleDown(src, saliencySize), exifOrientation(i.Data)))
+	return nil
+}
+
+// focusStoredImages finds the focus of images stored before it was found for images without faces
+func focusStoredImages() {
+	keys, err := imageKeys(bh.Where("Focused").Eq(false).And("Kind").Eq(kindImage))
+	if err != nil {
+		log.Printf("Error finding images to focus: %s\n", err)
+		return
+	}
+	for _, key := range keys {
+		err = updateImage(key, func(img *image) {
+			if err := img.findFocus(); err != nil {
+				log.Printf("Error finding the focus of %s: %s\n", img.Key, err)
+			}
+		})
+		if err != nil {
+			log.Printf("Error storing the focus of %s: %s\n", key, err)
+		}
+	}
+}
+
+// blurFill scales an image to fit in width by height, and fills the rest with a blurred, darkened
+// copy of it scaled to cover the whole size
+func blurFill(src goimage.Image, width, height int) goimage.Image {
+	b := src.Bounds()
+	scale := math.Min(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+	if scale > 1 {
+		// the browser scales small images up just as well
+		width, height = maxInt(1, int(float64(width)/scale)), maxInt(1, int(float64(height)/scale))
+		scale = 1
+	}
+	dst := goimage.NewRGBA(goimage.Rect(0, 0, width, height))
+
+	cropWidth, cropHeight := coverSize(b, width, height)
+	background := goimage.NewRGBA(goimage.Rect(0, 0, maxInt(1, width/blurScale), maxInt(1, height/blurScale)))
+	draw.ApproxBiLinear.Scale(background, background.Bounds(), src,
+		focusCrop(b, &focalPoint{X: 0.5, Y: 0.5}, cropWidth, cropHeight), draw.Src, nil)
+	boxBlur(background, 2)
+	boxBlur(background, 2)
+	draw.BiLinear.Scale(dst, dst.Bounds(), background, background.Bounds(), draw.Src, nil)
+	draw.Draw(dst, dst.Bounds(), goimage.NewUniform(color.RGBA{A: 96}), goimage.Point{}, draw.Over)
+
+	fitWidth, fitHeight := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+	x, y := (width-fitWidth)/2, (height-fitHeight)/2
+	draw.CatmullRom.Scale(dst, goimage.Rect(x, y, x+fitWidth, y+fitHeight), src, b, draw.Over, nil)
+	return dst
+}
+
+// boxBlur blurs an image in place by averaging each pixel with those within radius of it
+func boxBlur(img *goimage.RGBA, radius int) {
+	b := img.Bounds()
+	blur := func(length int, pixel func(i int) int) {
+		sums := make([][4]int, length+1)
+		offsets := make([]int, length)
+		for i := 0; i < length; i++ {
+			offsets[i] = pixel(i)
+			for c := 0; c < 4; c++ {
+				sums[i+1][c] = sums[i][c] + int(img.Pix[offsets[i]+c])
+			}
+		}
+		for i := 0; i < length; i++ {
+			from, to := maxInt(0, i-radius), minInt(length, i+radius+1)
+			for c := 0; c < 4; c++ {
+				img.Pix[offsets[i]+c] = uint8((sums[to][c] - sums[from][c]) / (to - from))
+			}
+		}
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		blur(b.Dx(), func(i int) int { return img.PixOffset(b.Min.X+i, y) })
+	}
+	for x := b.Min.X; x < b.Max.X; x++ {
+		blur(b.Dy(), func(i int) int { return img.PixOffset(x, b.Min.Y+i) })
+	}
+}
+
+// minInt returns the smallest of values
+func minInt(value int, values ...int) int {
+	for _, v := range values {
+		if v < value {
+			value = v
+		}
+	}
+	return value
+}
+
+// maxInt returns the largest of values
+func maxInt(value int, values ...int) int {
+	for _, v := range values {
+		if v > value {
+			value = v
+		}
+	}
+	return value
+}
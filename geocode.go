@@ -0,0 +1,223 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/biter777/countries"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+)
+
+const (
+	cityDistance    = 50.0  // km, images taken closer than this to a city are named after it
+	countryDistance = 300.0 // km, images taken further than this from any city aren't given a place
+	earthRadius     = 6371.0
+)
+
+// geoPoint is where an image was taken
+type geoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// place is a named location images are placed in
+type place struct {
+	name    string
+	country string // ISO 3166 code
+	point   geoPoint
+}
+
+var places = struct {
+	sync.Once
+	all []place
+	err error
+}{}
+
+// loadPlaces returns the places in the file set in places.file, or the bundled places if it isn't set.
+// Everything is kept locally, so places are found without a network
+func loadPlaces() ([]place, error) {
+	places.Do(func() {
+		file := viper.GetString("places.file")
+		if file == "" {
+			places.all, places.err = parsePlaces(strings.NewReader(bundledPlaces), 0, 1, 2, 3)
+			return
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			places.err = err
+			return
+		}
+		defer f.Close()
+		// GeoNames' cities files, i.e. cities15000.txt from https://download.geonames.org/export/dump/
+		places.all, places.err = parsePlaces(f, 1, 8, 4, 5)
+	})
+	return places.all, places.err
+}
+
+// parsePlaces reads places from tab separated lines, with the name, country, latitude and longitude in
+// the passed in columns
+func parsePlaces(r io.Reader, name, country, latitude, longitude int) ([]place, error) {
+	columns := maxInt(name, country, latitude, longitude) + 1
+	var all []place
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < columns {
+			return nil, fmt.Errorf("Invalid place on line %d: expected %d columns", line, columns)
+		}
+		lat, err := strconv.ParseFloat(fields[latitude], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid latitude on line %d: %s", line, err)
+		}
+		lon, err := strconv.ParseFloat(fields[longitude], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid longitude on line %d: %s", line, err)
+		}
+		all = append(all, place{
+			name:    fields[name],
+			country: fields[country],
+			point:   geoPoint{Latitude: lat, Longitude: lon},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("No places found")
+	}
+	return all, nil
+}
+
+// reverseGeocode returns the name of the place a point is in, and its country's ISO 3166 code.  Points
+// near a city are named after it and its country, points further from one after the country of the
+// closest city
+func reverseGeocode(point geoPoint) (string, string, error) {
+	all, err := loadPlaces()
+	if err != nil {
+		return "", "", err
+	}
+
+	var nearest *place
+	closest := math.Inf(1)
+	for i := range all {
+		if d := distance(point, all[i].point); d < closest {
+			nearest, closest = &all[i], d
+		}
+	}
+	if nearest == nil || closest > countryDistance {
+		return "", "", nil
+	}
+
+	country := countryName(nearest.country)
+	if closest > cityDistance {
+		return country, nearest.country, nil
+	}
+	return nearest.name + ", " + country, nearest.country, nil
+}
+
+// countryName returns the short English name of a country's ISO 3166 code
+func countryName(code string) string {
+	c := countries.ByName(code)
+	if c == countries.Unknown {
+		return code
+	}
+	// Iran (Islamic Republic of) is shown as Iran
+	name := c.String()
+	if i := strings.Index(name, " ("); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// countryCode returns the ISO 3166 code of a country's name or code, or an empty string if it isn't one
+func countryCode(name string) string {
+	c := countries.ByName(name)
+	if c == countries.Unknown {
+		return ""
+	}
+	return c.Alpha2()
+}
+
+// distance returns the distance between two points in km, along the surface of the earth
+func distance(a, b geoPoint) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// exifLocation returns where a photo was taken from its EXIF GPS data
+func exifLocation(data []byte) *geoPoint {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	lat, lon, err := x.LatLong()
+	// cameras without a fix sometimes write 0, 0
+	if err != nil || math.IsNaN(lat) || math.IsNaN(lon) || (lat == 0 && lon == 0) {
+		return nil
+	}
+	return &geoPoint{Latitude: lat, Longitude: lon}
+}
+
+// locate sets where an image was taken, and the name of the place, from the EXIF data of the image's
+// original data
+func (i *image) locate(data []byte) error {
+	if i.Located || i.isVideo() {
+		return nil
+	}
+	i.Location = exifLocation(data)
+	if i.Location != nil {
+		var err error
+		i.Place, i.Country, err = reverseGeocode(*i.Location)
+		if err != nil {
+			return err
+		}
+	}
+	i.Located = true
+	return nil
+}
+
+// locateStoredImages places images stored before images were placed
+func locateStoredImages() {
+	keys, err := imageKeys(bh.Where("Located").Eq(false).And("Kind").Eq(kindImage))
+	if err != nil {
+		log.Printf("Error finding images to locate: %s\n", err)
+		return
+	}
+
+	for _, key := range keys {
+		err = updateImage(key, func(img *image) {
+			// transcoded images may have lost their EXIF data
+			data := img.Data
+			orig := &original{}
+			if err := store.Get(img.Key, orig); err == nil {
+				data = orig.Data
+			}
+			if err := img.locate(data); err != nil {
+				log.Printf("Error locating %s: %s\n", img.Key, err)
+			}
+		})
+		if err != nil {
+			log.Printf("Error storing location of %s: %s\n", key, err)
+		}
+	}
+}
@@ -20,11 +20,16 @@ type google struct {
 	urls []string
 }
 
-func (g *google) initialize(config providerConfig) error {
-	if urls, ok := config.getStringSlice("urls"); ok {
-		g.urls = urls
-	}
+type googleConfig struct {
+	URLs []string `config:"urls"`
+}
 
+func (g *google) initialize(config *configSection) error {
+	settings := googleConfig{}
+	if err := config.decode(&settings); err != nil {
+		return err
+	}
+	g.urls = settings.URLs
 	return nil
 }
 
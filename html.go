@@ -10,11 +10,41 @@ const html = `
     <meta charset="utf-8">
     <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
     <title>Photo Frame</title>
+    <script type="text/javascript">
+	// the server pairs images which don't fit the screen's orientation
+	document.cookie = "layout=" + (window.innerWidth >= window.innerHeight ? "landscape" : "portrait") + "; path=/";
+	document.cookie = "screen=" + Math.round(window.innerWidth * window.devicePixelRatio) + "x" +
+		Math.round(window.innerHeight * window.devicePixelRatio) + "; path=/";
+    </script>
     <style>
     	body {
 		background-color: #000;
 	}
-    	.img-container {
+	.slide, .previous-slide {
+		position: absolute;
+		top: 0;
+		bottom: 0;
+		left: 0;
+		right: 0;
+		display: flex;
+		flex-direction: {{if eq .Layout "portrait"}}column{{else}}row{{end}};
+	}
+	.slide, .video {
+		animation: {{.Transition}}-in {{.TransitionDuration}}ms ease-in-out both;
+	}
+	.previous-slide {
+		display: none;
+	}
+	.previous-slide.show {
+		display: flex;
+		animation: {{.Transition}}-out {{.TransitionDuration}}ms ease-in-out both;
+	}
+	.img-container {
+		position: relative;
+		flex: 1;
+		overflow: hidden;
+	}
+	.img {
 		position: absolute;
 		top: 0;
 		bottom: 0;
@@ -23,53 +53,425 @@ const html = `
 		background-size: contain;
 		background-repeat: no-repeat;
 		background-position: center;
-		background-image: url("/image");
-		-webkit-animation: fadein 2s; /* Safari, Chrome and Opera > 12.1 */
-		-moz-animation: fadein 2s; /* Firefox < 16 */
-		-ms-animation: fadein 2s; /* Internet Explorer */
-		-o-animation: fadein 2s; /* Opera < 12.1 */
-		animation: fadein 2s;
 	}
-
-	@keyframes fadein {
-	    from { opacity: 0; }
-	    to   { opacity: 1; }
+	/* variants are rendered close to the shape of the display, and fill it */
+	.img.fitted {
+		background-size: cover;
+	}
+	.kenburns .img {
+		animation: {{if .ZoomOut}}kenburns-farther{{else}}kenburns-closer{{end}} {{.KenBurnsDuration}}ms linear both;
+	}
+	.paused-animation .slide, .paused-animation .img, .paused-animation .previous-slide, .paused-animation .title-card {
+		animation-play-state: paused;
+	}
+	/* which of the paired images the controls apply to */
+	.controls-shown .paired .selected {
+		box-shadow: inset 0 0 0 3px #fc0;
 	}
 
-	/* Firefox < 16 */
-	@-moz-keyframes fadein {
-	    from { opacity: 0; }
-	    to   { opacity: 1; }
+	.video {
+		position: absolute;
+		top: 0;
+		left: 0;
+		width: 100%;
+		height: 100%;
+		object-fit: contain;
+	}
+	.video.cover {
+		object-fit: cover;
 	}
 
-	/* Safari, Chrome and Opera > 12.1 */
-	@-webkit-keyframes fadein {
-	    from { opacity: 0; }
-	    to   { opacity: 1; }
+	.caption {
+		position: absolute;
+		bottom: 0;
+		width: 100%;
+		padding: 1em 0;
+		color: #fff;
+		text-align: center;
+		text-shadow: 0 0 4px #000;
+		font-family: sans-serif;
+	}
+	.place {
+		position: absolute;
+		top: 0;
+		left: 0;
+		padding: 1em;
+		color: #fff;
+		font-size: 0.8em;
+		text-shadow: 0 0 4px #000;
+		font-family: sans-serif;
+	}
+	/* introduces each event in story order, fading out to the first image */
+	.title-card {
+		position: absolute;
+		top: 0;
+		left: 0;
+		width: 100%;
+		height: 100%;
+		display: flex;
+		flex-direction: column;
+		justify-content: center;
+		align-items: center;
+		color: #fff;
+		background-color: rgba(0, 0, 0, 0.6);
+		text-shadow: 0 0 4px #000;
+		font-family: sans-serif;
+		pointer-events: none;
+		animation: title-card {{.Duration}}ms ease-in both;
+	}
+	.title-card h1 {
+		margin: 0 0 0.25em 0;
+		font-size: 3em;
+		font-weight: normal;
+	}
+	.title-card p {
+		margin: 0;
+		font-size: 1.5em;
 	}
 
-	/* Internet Explorer */
-	@-ms-keyframes fadein {
-	    from { opacity: 0; }
-	    to   { opacity: 1; }
+	.controls {
+		position: absolute;
+		top: 0;
+		width: 100%;
+		padding: 1em 0;
+		text-align: center;
+		background-color: rgba(0, 0, 0, 0.5);
+		display: none;
+	}
+	.controls.show {
+		display: block;
+	}
+	.controls button {
+		font-size: 2em;
+		margin: 0 0.25em;
+		color: #888;
+		background: none;
+		border: none;
+	}
+	.controls button.active {
+		color: #fc0;
+	}
+	.paused {
+		position: absolute;
+		top: 1em;
+		right: 1em;
+		color: #fff;
+		text-shadow: 0 0 4px #000;
+		display: none;
+	}
+	.paused.show {
+		display: block;
 	}
 
-	/* Opera < 12.1 */
-	@-o-keyframes fadein {
+	@keyframes crossfade-in {
 	    from { opacity: 0; }
 	    to   { opacity: 1; }
 	}
+	@keyframes crossfade-out {
+	    from { opacity: 1; }
+	    to   { opacity: 0; }
+	}
+	@keyframes slide-in {
+	    from { transform: translateX(100%); }
+	    to   { transform: translateX(0); }
+	}
+	@keyframes slide-out {
+	    from { transform: translateX(0); }
+	    to   { transform: translateX(-100%); }
+	}
+	@keyframes zoom-in {
+	    from { opacity: 0; transform: scale(1.3); }
+	    to   { opacity: 1; transform: scale(1); }
+	}
+	@keyframes zoom-out {
+	    from { opacity: 1; transform: scale(1); }
+	    to   { opacity: 0; transform: scale(0.8); }
+	}
+	@keyframes kenburns-closer {
+	    from { transform: scale(1); }
+	    to   { transform: scale(1.15); }
+	}
+	@keyframes kenburns-farther {
+	    from { transform: scale(1.15); }
+	    to   { transform: scale(1); }
+	}
+	@keyframes none-in {
+	}
+	@keyframes none-out {
+	}
+	@keyframes title-card {
+	    0%, 50% { opacity: 1; }
+	    100%    { opacity: 0; }
+	}
     </style>
   </head>
   <body>
-    <div class="img-container">
+    <div class="previous-slide"></div>
+    <script type="text/javascript">
+	// the previous slide is shown underneath while transitioning, its images are already in the browser's cache
+	(function() {
+		var previous = JSON.parse(window.sessionStorage.getItem("previousSlide") || "null");
+		if ({{.Transition}} === "none" || !previous || previous.join() === {{.Images}}.join()) {
+			return;
+		}
+		var layer = document.querySelector(".previous-slide");
+		previous.forEach(function(url) {
+			var container = document.createElement("div");
+			var img = document.createElement("div");
+			container.className = "img-container";
+			img.className = "img";
+			img.style.backgroundImage = 'url("' + url + '")';
+			container.appendChild(img);
+			layer.appendChild(container);
+		});
+		layer.classList.add("show");
+		layer.addEventListener("animationend", function() {
+			layer.classList.remove("show");
+		});
+	})();
+    </script>
+    {{if .Video}}
+    {{with index .Slide 0}}
+    <video class="video{{if eq .Fit "cover"}} cover{{end}}" src="{{.URL}}" data-key="{{.Key}}" data-favorite="{{.Favorite}}"
+      data-rating="{{.Rating}}" {{if not $.Paused}}autoplay{{end}} muted playsinline></video>
+    {{if .Caption}}<div class="caption">{{.Caption}}</div>{{end}}
+    {{if .Place}}<div class="place">{{.Place}}</div>{{end}}
+    {{end}}
+    {{else}}
+    <div class="slide{{if .KenBurns}} kenburns{{end}}{{if gt (len .Slide) 1}} paired{{end}}">
+      {{range .Slide}}
+      <div class="img-container" data-key="{{.Key}}" data-favorite="{{.Favorite}}" data-rating="{{.Rating}}">
+        <div class="img{{if ne .Fit "contain"}} fitted{{end}}" style="background-image: url('{{.URL}}'); transform-origin: {{.FocusX}}% {{.FocusY}}%"></div>
+        {{if .Caption}}<div class="caption">{{.Caption}}</div>{{end}}
+        {{if .Place}}<div class="place">{{.Place}}</div>{{end}}
+      </div>
+      {{end}}
+    </div>
+    {{end}}
+    {{with .Title}}
+    <div class="title-card">
+      {{if .Place}}<h1>{{.Place}}</h1>{{end}}
+      <p>{{.Dates}}</p>
+    </div>
+    {{end}}
+    <div class="paused">&#10074;&#10074;</div>
+    <div class="controls">
+      <button class="previous" title="Previous (&#8592;)">&#9198;</button>
+      <button class="pause" title="Pause (space)">&#9199;</button>
+      <button class="next" title="Next (&#8594;)">&#9197;</button>
+      <button class="favorite" title="Favorite (f)">&#9829;</button>
+      <button class="rate" data-rating="1" title="Rate (1-5, 0 to clear)">&#9733;</button>
+      <button class="rate" data-rating="2" title="Rate (1-5, 0 to clear)">&#9733;</button>
+      <button class="rate" data-rating="3" title="Rate (1-5, 0 to clear)">&#9733;</button>
+      <button class="rate" data-rating="4" title="Rate (1-5, 0 to clear)">&#9733;</button>
+      <button class="rate" data-rating="5" title="Rate (1-5, 0 to clear)">&#9733;</button>
+      <button class="hide" title="Hide (h)">&#10005;</button>
     </div>
   </body>
 <script type="text/javascript">
 	(function() {
-		window.setTimeout(function() {
-			window.location.reload();
-		}, {{.Duration}});
+		var images = {{.Images}};
+		var session = {{.Session}};
+		var paused = {{.Paused}};
+		var items = document.querySelectorAll("[data-key]");
+		var item, key, favorite, rating;
+		var video = document.querySelector("video");
+		var controls = document.querySelector(".controls");
+		var controlsTimer;
+		var timer;
+
+		// the next page transitions from this slide
+		var leave = function(url) {
+			if (video) {
+				window.sessionStorage.removeItem("previousSlide");
+			} else {
+				window.sessionStorage.setItem("previousSlide", JSON.stringify(images));
+			}
+			window.location.replace(url);
+		};
+
+		var next = function() {
+			leave("/");
+		};
+
+		var previous = function() {
+			leave("/?go=previous");
+		};
+
+		var post = function(url, params) {
+			var body = new URLSearchParams();
+			for (var name in params) {
+				body.set(name, params[name]);
+			}
+			return fetch(url, {method: "POST", body: body});
+		};
+
+		var update = function(action, field, value) {
+			var params = {key: key};
+			params[field] = value;
+			return post("/image/" + action, params);
+		};
+
+		var setPaused = function(value) {
+			paused = value;
+			document.querySelector(".pause").classList.toggle("active", paused);
+			document.querySelector(".paused").classList.toggle("show", paused);
+			document.body.classList.toggle("paused-animation", paused);
+			window.clearTimeout(timer);
+			if (video) {
+				// videos are played through once before moving on
+				if (paused) {
+					video.pause();
+				} else {
+					video.play();
+				}
+				return;
+			}
+			if (!paused) {
+				timer = window.setTimeout(next, {{.Duration}});
+			}
+		};
+
+		var togglePause = function() {
+			setPaused(!paused);
+			// keep the session paused across pages
+			post("/control/" + (paused ? "pause" : "resume"), {session: session});
+		};
+
+		var showRating = function() {
+			document.querySelectorAll(".rate").forEach(function(button) {
+				button.classList.toggle("active", button.dataset.rating <= rating);
+			});
+		};
+
+		// select which image of the slide the controls apply to
+		var select = function(selected) {
+			items.forEach(function(i) {
+				i.classList.toggle("selected", i === selected);
+			});
+			item = selected;
+			key = item.dataset.key;
+			favorite = item.dataset.favorite === "true";
+			rating = parseInt(item.dataset.rating, 10);
+			document.querySelector(".favorite").classList.toggle("active", favorite);
+			showRating();
+		};
+
+		var showControls = function() {
+			controls.classList.add("show");
+			document.body.classList.add("controls-shown");
+			window.clearTimeout(controlsTimer);
+			controlsTimer = window.setTimeout(function() {
+				controls.classList.remove("show");
+				document.body.classList.remove("controls-shown");
+			}, 5000);
+		};
+
+		var toggleFavorite = function() {
+			favorite = !favorite;
+			item.dataset.favorite = favorite;
+			document.querySelector(".favorite").classList.toggle("active", favorite);
+			update("favorite", "favorite", favorite);
+		};
+
+		var rate = function(value) {
+			rating = value;
+			item.dataset.rating = value;
+			showRating();
+			update("rate", "rating", rating);
+		};
+
+		// hidden images can't be shown again, so a stray tap or keypress mustn't hide one
+		var hide = function() {
+			if (!confirm("Hide this image for good? It can't be shown again.")) {
+				return;
+			}
+			update("hide", "hidden", true).then(next);
+		};
+
+		document.querySelector(".favorite").addEventListener("click", toggleFavorite);
+		document.querySelector(".hide").addEventListener("click", hide);
+		document.querySelector(".previous").addEventListener("click", previous);
+		document.querySelector(".pause").addEventListener("click", togglePause);
+		document.querySelector(".next").addEventListener("click", next);
+		document.querySelectorAll(".rate").forEach(function(button) {
+			button.addEventListener("click", function() {
+				rate(parseInt(button.dataset.rating, 10));
+			});
+		});
+
+		// tap the edges of the screen to go back or forward, anywhere else for the controls
+		document.body.addEventListener("click", function(e) {
+			if (e.target.closest(".controls")) {
+				return;
+			}
+			if (e.clientX < window.innerWidth / 5) {
+				previous();
+			} else if (e.clientX > window.innerWidth * 4 / 5) {
+				next();
+			} else {
+				var selected = e.target.closest("[data-key]");
+				if (selected) {
+					select(selected);
+				}
+				showControls();
+			}
+		});
+
+		var touchX;
+		document.body.addEventListener("touchstart", function(e) {
+			touchX = e.changedTouches[0].clientX;
+		});
+		document.body.addEventListener("touchend", function(e) {
+			var dx = e.changedTouches[0].clientX - touchX;
+			if (dx < -50) {
+				next();
+			} else if (dx > 50) {
+				previous();
+			}
+		});
+
+		document.addEventListener("keydown", function(e) {
+			if (e.key === "ArrowRight") {
+				next();
+			} else if (e.key === "ArrowLeft") {
+				previous();
+			} else if (e.key === " " || e.key === "p") {
+				togglePause();
+			} else if (e.key === "f") {
+				toggleFavorite();
+			} else if (e.key === "h" || e.key === "Delete") {
+				hide();
+			} else if (e.key >= "0" && e.key <= "5") {
+				rate(parseInt(e.key, 10));
+			}
+		});
+
+		// commands from remote controls
+		var events = new EventSource("/events?session=" + encodeURIComponent(session));
+		events.onmessage = function(e) {
+			if (e.data === "next") {
+				next();
+			} else if (e.data === "previous") {
+				previous();
+			} else if (e.data === "pause") {
+				setPaused(true);
+			} else if (e.data === "resume") {
+				setPaused(false);
+			}
+		};
+
+		if (video) {
+			video.addEventListener("ended", function() {
+				if (!paused) {
+					next();
+				}
+			});
+			video.addEventListener("error", next);
+		}
+
+		select(items[0]);
+		setPaused(paused);
 	})();
 </script>
 </html>
@@ -82,6 +484,12 @@ const loading = `
     <meta charset="utf-8">
     <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
     <title>Photo Frame</title>
+    <script type="text/javascript">
+	// the server pairs images which don't fit the screen's orientation
+	document.cookie = "layout=" + (window.innerWidth >= window.innerHeight ? "landscape" : "portrait") + "; path=/";
+	document.cookie = "screen=" + Math.round(window.innerWidth * window.devicePixelRatio) + "x" +
+		Math.round(window.innerHeight * window.devicePixelRatio) + "; path=/";
+    </script>
     <style>
     	body {
 		background-color: #000;
@@ -103,11 +511,24 @@ const loading = `
 		background-repeat: no-repeat;
 		background-position: center;
 	}
+	.upload {
+		position: absolute;
+		color: #fff;
+		text-align: center;
+		top: calc(50% + 4em);
+		width: 100%;
+	}
     </style>
   </head>
   <body>
     <div class="img-container">
 	    <h1 class="loading">Images are loading ...</h1>
+	    {{if .Upload}}
+	    <div class="upload">
+		    <img src="/upload/qr.png" alt="Upload QR code">
+		    <p>Scan to add photos</p>
+	    </div>
+	    {{end}}
     </div>
 
   </body>
@@ -120,3 +541,256 @@ const loading = `
 </script>
 </html>
 `
+
+const uploadPage = `
+<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+    <title>Photo Frame - Upload</title>
+    <style>
+	body {
+		background-color: #000;
+		color: #fff;
+		font-family: sans-serif;
+		margin: 0;
+		padding: 1em;
+	}
+	.drop {
+		border: 3px dashed #666;
+		border-radius: 1em;
+		padding: 3em 1em;
+		text-align: center;
+		font-size: 1.2em;
+	}
+	.drop.over {
+		border-color: #fff;
+	}
+	.drop input {
+		display: none;
+	}
+	.drop label {
+		display: inline-block;
+		margin-top: 1em;
+		padding: 0.75em 1.5em;
+		background-color: #333;
+		border-radius: 0.5em;
+		cursor: pointer;
+	}
+	ul {
+		list-style: none;
+		padding: 0;
+	}
+	li {
+		padding: 0.5em 0;
+		border-bottom: 1px solid #333;
+	}
+	.error {
+		color: #f66;
+	}
+    </style>
+  </head>
+  <body>
+    <div class="drop" id="drop">
+	    Drop photos and videos here
+	    <br>
+	    <label>Choose files<input type="file" id="files" multiple accept="image/*,video/*,.heic,.heif"></label>
+    </div>
+    <ul id="results"></ul>
+  </body>
+<script type="text/javascript">
+	(function() {
+		var drop = document.getElementById("drop");
+		var results = document.getElementById("results");
+
+		function upload(files) {
+			if (!files.length) {
+				return;
+			}
+			var form = new FormData();
+			for (var i = 0; i < files.length; i++) {
+				form.append("file", files[i], files[i].name);
+			}
+			var item = document.createElement("li");
+			item.textContent = "Uploading " + files.length + " file(s) ...";
+			results.insertBefore(item, results.firstChild);
+
+			var xhr = new XMLHttpRequest();
+			xhr.open("POST", "/upload" + location.search);
+			xhr.upload.onprogress = function(e) {
+				if (e.lengthComputable) {
+					item.textContent = "Uploading " + files.length + " file(s) ... " +
+						Math.round(e.loaded / e.total * 100) + "%";
+				}
+			};
+			xhr.onload = function() {
+				results.removeChild(item);
+				if (xhr.status != 200) {
+					show("Upload failed", xhr.responseText);
+					return;
+				}
+				JSON.parse(xhr.responseText).forEach(function(r) {
+					show(r.file, r.error);
+				});
+			};
+			xhr.onerror = function() {
+				item.textContent = "Upload failed";
+				item.className = "error";
+			};
+			xhr.send(form);
+		}
+
+		function show(file, error) {
+			var item = document.createElement("li");
+			item.textContent = file + (error ? ": " + error : ": added");
+			if (error) {
+				item.className = "error";
+			}
+			results.insertBefore(item, results.firstChild);
+		}
+
+		document.getElementById("files").addEventListener("change", function(e) {
+			upload(e.target.files);
+			e.target.value = "";
+		});
+		drop.addEventListener("dragover", function(e) {
+			e.preventDefault();
+			drop.className = "drop over";
+		});
+		drop.addEventListener("dragleave", function() {
+			drop.className = "drop";
+		});
+		drop.addEventListener("drop", function(e) {
+			e.preventDefault();
+			drop.className = "drop";
+			upload(e.dataTransfer.files);
+		});
+	})();
+</script>
+</html>
+`
+
+const peoplePage = `
+<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+    <title>Photo Frame - People</title>
+    <style>
+	body {
+		background-color: #000;
+		color: #fff;
+		font-family: sans-serif;
+		margin: 0;
+		padding: 1em;
+	}
+	.faces {
+		display: flex;
+		flex-wrap: wrap;
+		gap: 1em;
+	}
+	.face {
+		width: 160px;
+	}
+	.face img {
+		display: block;
+		width: 160px;
+		height: 160px;
+		border-radius: 0.5em;
+		background-color: #333;
+	}
+	.face input {
+		box-sizing: border-box;
+		width: 100%;
+		margin-top: 0.5em;
+		padding: 0.5em;
+		background-color: #333;
+		color: #fff;
+		border: 1px solid #666;
+		border-radius: 0.5em;
+	}
+	.face.saved input {
+		border-color: #6c6;
+	}
+	.error {
+		color: #f66;
+	}
+    </style>
+  </head>
+  <body>
+    <p>Name the people in your photos, then list who the frame shows in the people setting.</p>
+    <div class="faces" id="faces"></div>
+    <datalist id="people"></datalist>
+  </body>
+<script type="text/javascript">
+	(function() {
+		var faces = document.getElementById("faces");
+		var people = document.getElementById("people");
+
+		function request(method, url, body, done) {
+			var xhr = new XMLHttpRequest();
+			xhr.open(method, url);
+			xhr.onload = function() {
+				done(xhr);
+			};
+			if (body) {
+				xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+			}
+			xhr.send(body);
+		}
+
+		function addPerson(name) {
+			if (!name || people.querySelector('option[value="' + CSS.escape(name) + '"]')) {
+				return;
+			}
+			var option = document.createElement("option");
+			option.value = name;
+			people.appendChild(option);
+		}
+
+		function show(f) {
+			var item = document.createElement("div");
+			item.className = "face";
+			var img = document.createElement("img");
+			img.src = "/face?key=" + encodeURIComponent(f.key) + "&index=" + f.index;
+			img.loading = "lazy";
+			var name = document.createElement("input");
+			name.setAttribute("list", "people");
+			name.placeholder = "Who is this?";
+			name.value = f.person || "";
+			name.addEventListener("change", function() {
+				item.className = "face";
+				request("POST", "/face/name", "key=" + encodeURIComponent(f.key) + "&index=" + f.index +
+					"&person=" + encodeURIComponent(name.value.trim()), function(xhr) {
+					if (xhr.status != 204) {
+						item.className = "face error";
+						return;
+					}
+					item.className = "face saved";
+					addPerson(name.value.trim());
+				});
+			});
+			item.appendChild(img);
+			item.appendChild(name);
+			faces.appendChild(item);
+			addPerson(f.person);
+		}
+
+		request("GET", "/faces", null, function(xhr) {
+			if (xhr.status != 200) {
+				faces.textContent = "Error loading faces: " + xhr.responseText;
+				faces.className = "error";
+				return;
+			}
+			var found = JSON.parse(xhr.responseText) || [];
+			if (!found.length) {
+				faces.textContent = "No faces have been found, faces are only looked for when faces.cascade names a pico face detection cascade";
+			}
+			found.forEach(show);
+		});
+	})();
+</script>
+</html>
+`
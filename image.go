@@ -4,25 +4,83 @@
 package main
 
 import (
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
-	"github.com/spf13/viper"
 	bh "github.com/timshannon/bolthold"
 	"go.etcd.io/bbolt"
 )
 
 var store *bh.Store
 
+// kinds of media
+const (
+	kindImage = "image"
+	kindVideo = "video"
+)
+
 type image struct {
 	Key         string `boltholdKey:"Key"`
 	Date        time.Time
 	Provider    string `boltholdIndex:"Provider"`
 	Data        []byte
 	ContentType string
+	Kind        string
+	Caption     string
+	Sender      string
+	Held        bool  // held images aren't shown until they are approved
+	Size        int64 // bytes used by the image, including its original if it was transcoded
+	Pinned      bool  // pinned and favorite images are never evicted
+	Favorite    bool
+	Rating      int         // 0 for unrated, otherwise 1 to 5.  Eviction ranks unrated images as unratedRating
+	Hidden      bool        // hidden images are kept without their data so they aren't imported again
+	Focus       *focalPoint // what pans and zooms center on, nil for the center of the image
+	Focused     bool        // whether the focus has been looked for, for images without faces
+	Width       int         // as displayed, 0 for videos and images that couldn't be measured
+	Height      int
+	Faces       []face
+	People      []string // the names of the people whose faces have been named
+	// faces are detected once, since detection is slow and finding none is also a result
+	FacesDetected bool
+	Location      *geoPoint // where it was taken, nil if it isn't known
+	Place         string
+	Country       string `boltholdIndex:"Country"` // ISO 3166 code of the country it was taken in
+	Located       bool   // the location has been read, whether or not the image has one
+	Event         string `boltholdIndex:"Event"` // key of the event it was taken during, empty until it's grouped
+}
+
+func mediaKind(contentType string) string {
+	if strings.HasPrefix(contentType, "video/") {
+		return kindVideo
+	}
+	return kindImage
+}
+
+func (i *image) isVideo() bool {
+	return i.Kind == kindVideo
+}
+
+// storeTimeout is how long opening the data file waits for another process to close it
+const storeTimeout = 2 * time.Second
+
+// storeInUseError is returned when another process, usually the running frame, has the data file open
+type storeInUseError struct {
+	file string
+}
+
+func (e *storeInUseError) Error() string {
+	return fmt.Sprintf("The data file %s is in use, the frame is running: stop it first", e.file)
 }
 
-func openStore(file string) error {
-	s, err := bh.Open(file, 0666, nil)
+// openStore opens the data file, read only for commands which only look at images.  Only one process
+// can have the data file open for writing, so it fails instead of waiting while the frame is running
+func openStore(file string, readOnly bool) error {
+	s, err := bh.Open(file, 0666, &bh.Options{Options: &bbolt.Options{Timeout: storeTimeout, ReadOnly: readOnly}})
+	if err == bbolt.ErrTimeout {
+		return &storeInUseError{file: file}
+	}
 	if err != nil {
 		return err
 	}
@@ -31,6 +89,9 @@ func openStore(file string) error {
 }
 
 func closeStore() error {
+	if store == nil {
+		return nil
+	}
 	return store.Close()
 }
 
@@ -46,6 +107,11 @@ func getLastImage(provider string) (*image, error) {
 	return img, nil
 }
 
+// visibleImages is the base query for all images that can be shown on the frame
+func visibleImages() *bh.Query {
+	return bh.Where("Held").Eq(false).And("Hidden").Eq(false)
+}
+
 func getImage(key string) (*image, error) {
 	i := &image{}
 	err := store.Get(key, i)
@@ -64,26 +130,165 @@ func getImages(query *bh.Query) ([]*image, error) {
 	return images, nil
 }
 
+// imageKeys returns the keys of the images matching a query, reading the images one at a time instead
+// of holding them all in memory
+func imageKeys(query *bh.Query) ([]string, error) {
+	var keys []string
+	err := store.ForEach(query, func(img *image) error {
+		// hidden images have no data left to process
+		if !img.Hidden {
+			keys = append(keys, img.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func getHeldImages() ([]*image, error) {
+	return getImages(bh.Where("Held").Eq(true).SortBy("Date"))
+}
+
+// updateImage saves the changes made to an image by the update function
+func updateImage(key string, update func(img *image)) error {
+	img, err := getImage(key)
+	if err != nil {
+		return err
+	}
+	update(img)
+	return saveImage(img)
+}
+
+// saveImage updates a stored image, along with what eviction knows about it
+func saveImage(img *image) error {
+	return store.Bolt().Update(func(tx *bbolt.Tx) error {
+		err := store.TxUpdate(tx, img.Key, img)
+		if err != nil {
+			return err
+		}
+		return txSaveStored(tx, img)
+	})
+}
+
+// hideImage hides an image for good, removing its data and keeping only a small record of it so that
+// it isn't imported again
+func hideImage(key string) error {
+	return store.Bolt().Update(func(tx *bbolt.Tx) error {
+		img := &image{}
+		err := store.TxGet(tx, key, img)
+		if err != nil {
+			return err
+		}
+		img.Hidden = true
+		img.Data = nil
+		img.Size = 0
+		err = store.TxUpdate(tx, img.Key, img)
+		if err != nil {
+			return err
+		}
+		err = store.TxDelete(tx, img.Key, &original{})
+		if err != nil && err != bh.ErrNotFound {
+			return err
+		}
+		err = txSaveStored(tx, img)
+		if err != nil {
+			return err
+		}
+		return txDeleteVariants(tx, img.Key)
+	})
+}
+
+// stripHiddenImages removes the data of images hidden before hidden images were stripped of it
+func stripHiddenImages() {
+	var keys []string
+	err := store.ForEach(bh.Where("Hidden").Eq(true), func(img *image) error {
+		if len(img.Data) > 0 {
+			keys = append(keys, img.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error finding hidden images: %s\n", err)
+		return
+	}
+	for _, key := range keys {
+		if err = hideImage(key); err != nil {
+			log.Printf("Error removing the data of hidden image %s: %s\n", key, err)
+		}
+	}
+}
+
+func deleteImage(key string) error {
+	err := store.Delete(key, &image{})
+	if err != nil {
+		return err
+	}
+	for _, dataType := range []interface{}{&original{}, &shown{}, &stored{}} {
+		err = store.Delete(key, dataType)
+		if err != nil && err != bh.ErrNotFound {
+			return err
+		}
+	}
+	return store.DeleteMatching(&variant{}, bh.Where("Image").Eq(key))
+}
+
 func addImages(images []*image) error {
+	var originals []*original
+	added := make([]*image, 0, len(images))
+	for _, img := range images {
+		// located before transcoding, which can lose the EXIF data
+		if err := img.locate(img.Data); err != nil {
+			log.Printf("Error locating %s: %s\n", img.Key, err)
+		}
+		orig, err := transcode(img)
+		if err != nil {
+			// better to skip it than to show a blank screen
+			log.Printf("Error transcoding %s from %s, skipping: %s\n", img.Key, img.ContentType, err)
+			continue
+		}
+		img.Size = int64(len(img.Data))
+		if orig != nil {
+			originals = append(originals, orig)
+			img.Size += int64(len(orig.Data))
+		}
+		if img.Kind == "" {
+			img.Kind = mediaKind(img.ContentType)
+		}
+		img.measure()
+		if err := img.detectFaces(); err != nil {
+			log.Printf("Error detecting faces in %s: %s\n", img.Key, err)
+		}
+		if err := img.findFocus(); err != nil {
+			log.Printf("Error finding the focus of %s: %s\n", img.Key, err)
+		}
+		added = append(added, img)
+	}
+
 	return store.Bolt().Update(func(tx *bbolt.Tx) error {
-		for i := range images {
-			err := store.TxInsert(tx, images[i].Key, images[i])
+		for i := range added {
+			err := assignEvent(tx, added[i])
+			if err != nil {
+				return err
+			}
+			err = store.TxInsert(tx, added[i].Key, added[i])
+			if err != nil {
+				return err
+			}
+			err = txSaveStored(tx, added[i])
 			if err != nil {
 				return err
 			}
 		}
 
-		all := &bh.Query{}
-
-		count, err := store.TxCount(tx, &image{}, all)
-		if err != nil {
-			return err
-		}
-		if count <= viper.GetInt("maxImageCount") {
-			return nil
+		for i := range originals {
+			err := store.TxUpsert(tx, originals[i].Key, originals[i])
+			if err != nil {
+				return err
+			}
 		}
 
-		return store.TxDeleteMatching(tx, &image{},
-			all.SortBy("Date").Limit(count-viper.GetInt("maxImageCount")))
+		return evict(tx)
 	})
 }
@@ -39,6 +39,7 @@ type instagramNode struct {
 	ShortCode    string `json:"shortcode"`
 	ThumbnailURL string `json:"thumbnail_src"`
 	IsVideo      bool   `json:"is_video"`
+	VideoURL     string `json:"video_url"`
 	Date         int    `json:"date"`
 	Dimensions   struct {
 		Width  int `json:"width"`
@@ -46,6 +47,14 @@ type instagramNode struct {
 	} `json:"dimensions"`
 }
 
+// mediaURL is where the video is for videos, the image otherwise
+func (n *instagramNode) mediaURL() string {
+	if n.IsVideo && n.VideoURL != "" {
+		return n.VideoURL
+	}
+	return n.ImageURL
+}
+
 type instagramPageData struct {
 	Rhxgis    string `json:"rhx_gis"`
 	EntryData struct {
@@ -92,18 +101,51 @@ type instagramNextPageData struct {
 
 type instagram struct {
 	accounts []string
+
+	// API access, used instead of scraping accounts if an access token is set
+	accessToken string
+	userID      string
+	apiURL      string
 }
 
-func (i *instagram) initialize(config providerConfig) error {
-	if accounts, ok := config.getStringSlice("accounts"); ok {
-		i.accounts = accounts
+type instagramConfig struct {
+	Accounts    []string `config:"accounts"`
+	AccessToken secret   `config:"accessToken"`
+	UserID      string   `config:"userID"`
+	APIURL      string   `config:"apiURL"`
+}
+
+func (i *instagram) initialize(config *configSection) error {
+	settings := instagramConfig{UserID: "me", APIURL: instagramAPIURL}
+	if err := config.decode(&settings); err != nil {
+		return err
 	}
 
+	i.accounts = settings.Accounts
+	i.accessToken = string(settings.AccessToken)
+	i.userID = settings.UserID
+	i.apiURL = settings.APIURL
+	return nil
+}
+
+// reloadSecrets uses the access token in the reloaded config
+func (i *instagram) reloadSecrets(config *configSection) error {
+	settings := instagramConfig{}
+	if err := config.decode(&settings); err != nil {
+		return err
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	i.accessToken = string(settings.AccessToken)
 	return nil
 }
 
 func (i *instagram) name() string { return "instagram" }
 func (i *instagram) getImages(lastImage *image) ([]*image, error) {
+	if readSecret(&i.accessToken) != "" {
+		return i.getAPIImages()
+	}
+
 	if len(i.accounts) == 0 {
 		return nil, nil
 	}
@@ -116,7 +158,8 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 		done := false
 		var actualUserID string
 
-		c := colly.NewCollector(colly.UserAgent(userAgent))
+		// bodies past maxVideoSize are cut short, and skipped
+		c := colly.NewCollector(colly.UserAgent(userAgent), colly.MaxBodySize(maxVideoSize+1))
 
 		c.OnRequest(func(r *colly.Request) {
 			if done {
@@ -158,10 +201,6 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 				page := data.EntryData.ProfilePage[0]
 				actualUserID = page.Graphql.User.ID
 				for _, obj := range page.Graphql.User.Media.Edges {
-					// skip videos
-					if obj.Node.IsVideo {
-						continue
-					}
 					c.Visit(fmt.Sprintf("https://www.instagram.com/p/%s", obj.Node.ShortCode))
 				}
 				nextPageVars := fmt.Sprintf(instagramNextPagePayload, actualUserID,
@@ -180,14 +219,10 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 			} else if len(data.EntryData.PostPage) > 0 {
 				page := data.EntryData.PostPage[0]
 				if len(page.Graphql.ShortCodeMedia.EdgeSidecarToChildren.Edges) == 0 {
-					c.Visit(page.Graphql.ShortCodeMedia.ImageURL)
+					c.Visit(page.Graphql.ShortCodeMedia.mediaURL())
 				} else {
 					for _, obj := range page.Graphql.ShortCodeMedia.EdgeSidecarToChildren.Edges {
-						// skip videos
-						if obj.Node.IsVideo {
-							continue
-						}
-						c.Visit(obj.Node.ImageURL)
+						c.Visit(obj.Node.mediaURL())
 					}
 				}
 			}
@@ -201,7 +236,8 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 			if done {
 				return
 			}
-			if strings.Index(r.Headers.Get("Content-Type"), "image") > -1 {
+			contentType := r.Headers.Get("Content-Type")
+			if strings.Index(contentType, "image") > -1 || strings.Index(contentType, "video") > -1 {
 				if lastImage != nil && lastImage.Key == r.FileName() {
 					done = true
 					return
@@ -218,6 +254,11 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 					return
 				}
 
+				if len(r.Body) > maxVideoSize {
+					// only short clips are shown
+					return
+				}
+
 				dt, err := time.Parse("Mon, 02 Jan 2006 15:04:05 MST", r.Headers.Get("Last-Modified"))
 				if err != nil {
 					dt = time.Now()
@@ -227,7 +268,8 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 					Date:        dt,
 					Data:        r.Body,
 					Provider:    i.name(),
-					ContentType: r.Headers.Get("Content-Type"),
+					ContentType: contentType,
+					Kind:        mediaKind(contentType),
 				})
 				imgCount++
 				if imgCount >= maxImagesPerPoll {
@@ -247,10 +289,6 @@ func (i *instagram) getImages(lastImage *image) ([]*image, error) {
 			}
 
 			for _, obj := range data.Data.User.Container.Edges {
-				// skip videos
-				if obj.Node.IsVideo {
-					continue
-				}
 				// c.Visit(obj.Node.ImageURL)
 				c.Visit(fmt.Sprintf("https://www.instagram.com/p/%s", obj.Node.ShortCode))
 			}
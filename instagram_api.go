@@ -0,0 +1,331 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	bh "github.com/timshannon/bolthold"
+)
+
+const (
+	instagramAPIURL        = "https://graph.instagram.com"
+	instagramMediaFields   = "id,media_type,media_url,timestamp,children{id,media_type,media_url,timestamp}"
+	instagramChildFields   = "id,media_type,media_url,timestamp"
+	instagramTimeFormat    = "2006-01-02T15:04:05-0700"
+	instagramTokenRefresh  = 24 * time.Hour
+	instagramMediaPageSize = "25"
+)
+
+type instagramMedia struct {
+	ID        string `json:"id"`
+	MediaType string `json:"media_type"`
+	MediaURL  string `json:"media_url"`
+	Timestamp string `json:"timestamp"`
+	Children  struct {
+		Data []instagramMedia `json:"data"`
+	} `json:"children"`
+}
+
+type instagramMediaPage struct {
+	Data   []instagramMedia `json:"data"`
+	Paging struct {
+		Cursors struct {
+			After string `json:"after"`
+		} `json:"cursors"`
+		Next string `json:"next"`
+	} `json:"paging"`
+}
+
+type instagramAPIError struct {
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+}
+
+// instagramToken is the current long lived access token, which replaces the configured token once it
+// has been refreshed, since long lived tokens expire after 60 days
+type instagramToken struct {
+	Key       string `boltholdKey:"Key"`
+	Token     string // tokens stored before they were sealed
+	Sealed    sealed
+	Refreshed time.Time
+	Expires   time.Time
+}
+
+// instagramBacklog is where paging through older media carries on from, after a poll found more new
+// media than it could import at once
+type instagramBacklog struct {
+	Key   string `boltholdKey:"Key"`
+	After string // cursor of the page to carry on from, empty for the first page
+}
+
+// getAPIImages imports the account's new media, newest first until media which has already been
+// imported.  Polls which stop at maxImagesPerPoll leave a backlog, which later polls carry on through
+// once they've imported the newest media
+func (i *instagram) getAPIImages() ([]*image, error) {
+	token, err := i.token()
+	if err != nil {
+		return nil, err
+	}
+
+	images, resume, err := i.pageMedia(token, "", true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "instagram.backlog." + i.userID
+	backlog, err := getInstagramBacklog(key)
+	if err != nil {
+		return nil, err
+	}
+	if resume == nil && backlog != nil {
+		images, resume, err = i.pageMedia(token, backlog.After, false, images)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resume != nil {
+		err = store.Upsert(key, &instagramBacklog{Key: key, After: *resume})
+	} else if backlog != nil {
+		err = store.Delete(key, &instagramBacklog{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// getInstagramBacklog returns where paging through older media carries on from, or nil if there's
+// nothing left to import
+func getInstagramBacklog(key string) (*instagramBacklog, error) {
+	backlog := &instagramBacklog{}
+	err := store.Get(key, backlog)
+	if err == bh.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return backlog, nil
+}
+
+// pageMedia pages through the account's media from newest to oldest, starting at the after cursor, and
+// adds what hasn't been imported to images.  Media which has already been imported ends paging if
+// stopAtImported is set, and is skipped otherwise.  If it stops at maxImagesPerPoll it returns the
+// cursor of the page to carry on from, and nil if it got to the end
+func (i *instagram) pageMedia(token, after string, stopAtImported bool, images []*image) ([]*image, *string,
+	error) {
+	found := make(map[string]bool, len(images))
+	for _, img := range images {
+		found[img.Key] = true
+	}
+	for {
+		page := &instagramMediaPage{}
+		err := i.apiGet(fmt.Sprintf("/%s/media", i.userID), url.Values{
+			"fields": {instagramMediaFields},
+			"limit":  {instagramMediaPageSize},
+			"after":  {after},
+		}, token, page)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, media := range page.Data {
+			items := []instagramMedia{media}
+			if media.MediaType == "CAROUSEL_ALBUM" {
+				items, err = i.children(media, token)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+
+			for _, item := range items {
+				if item.MediaType != "IMAGE" && item.MediaType != "VIDEO" {
+					continue
+				}
+
+				key := "instagram." + item.ID
+				if found[key] {
+					continue
+				}
+				_, err := getImage(key)
+				if err == nil {
+					if stopAtImported {
+						// everything older has already been imported, or is in the backlog
+						return images, nil, nil
+					}
+					continue
+				}
+				if err != bh.ErrNotFound {
+					return nil, nil, err
+				}
+
+				img, err := i.downloadMedia(key, item)
+				if err != nil {
+					return nil, nil, err
+				}
+				if img == nil {
+					continue
+				}
+				images = append(images, img)
+				found[key] = true
+				if len(images) >= maxImagesPerPoll {
+					// the rest of this page, and any carousel cut short, are imported next time
+					return images, &after, nil
+				}
+			}
+		}
+
+		if page.Paging.Next == "" || page.Paging.Cursors.After == "" {
+			return images, nil, nil
+		}
+		after = page.Paging.Cursors.After
+	}
+}
+
+// children returns the images in a carousel album, which inherit the album's timestamp if they
+// don't have their own
+func (i *instagram) children(album instagramMedia, token string) ([]instagramMedia, error) {
+	children := album.Children.Data
+	if len(children) == 0 {
+		page := &instagramMediaPage{}
+		err := i.apiGet(fmt.Sprintf("/%s/children", album.ID), url.Values{
+			"fields": {instagramChildFields},
+		}, token, page)
+		if err != nil {
+			return nil, err
+		}
+		children = page.Data
+	}
+
+	for c := range children {
+		if children[c].Timestamp == "" {
+			children[c].Timestamp = album.Timestamp
+		}
+	}
+	return children, nil
+}
+
+func (i *instagram) downloadMedia(key string, media instagramMedia) (*image, error) {
+	dt, err := time.Parse(instagramTimeFormat, media.Timestamp)
+	if err != nil {
+		dt = time.Now()
+	}
+
+	resp, err := http.Get(media.MediaURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error downloading instagram media %s: %s", media.ID, resp.Status)
+	}
+
+	if resp.ContentLength > maxVideoSize {
+		// only short clips are shown
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxVideoSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxVideoSize {
+		// only short clips are shown
+		return nil, nil
+	}
+
+	return &image{
+		Key:         key,
+		Date:        dt,
+		Data:        body,
+		Provider:    i.name(),
+		ContentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+func (i *instagram) apiGet(path string, values url.Values, token string, result interface{}) error {
+	values.Set("access_token", token)
+	resp, err := http.Get(i.apiURL + path + "?" + values.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &instagramAPIError{}
+		if json.Unmarshal(body, apiErr) == nil && apiErr.Error != nil {
+			return fmt.Errorf("Instagram API error %d %s: %s", apiErr.Error.Code, apiErr.Error.Type,
+				apiErr.Error.Message)
+		}
+		return fmt.Errorf("Instagram API error: %s", resp.Status)
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+// token returns the current access token, refreshing it once a day so that it never expires
+func (i *instagram) token() (string, error) {
+	accessToken := readSecret(&i.accessToken)
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(accessToken)))
+	t := &instagramToken{}
+	err := store.Get(key, t)
+	if err == bh.ErrNotFound {
+		t = &instagramToken{Key: key, Token: accessToken}
+	} else if err != nil {
+		return "", err
+	}
+	if t.Sealed != nil {
+		t.Token, err = t.Sealed.open()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if time.Since(t.Refreshed) < instagramTokenRefresh {
+		return t.Token, nil
+	}
+
+	refreshed := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	err = i.apiGet("/refresh_access_token", url.Values{"grant_type": {"ig_refresh_token"}}, t.Token,
+		refreshed)
+	if err != nil {
+		// the current token is still good until it expires
+		log.Printf("Error refreshing instagram access token: %s\n", err)
+		return t.Token, nil
+	}
+
+	t.Refreshed = time.Now()
+	t.Expires = t.Refreshed.Add(time.Duration(refreshed.ExpiresIn) * time.Second)
+	t.Token = ""
+	t.Sealed, err = seal(refreshed.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if err = store.Upsert(key, t); err != nil {
+		return "", err
+	}
+	return refreshed.AccessToken, nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// openTestStore opens a new data file for a test, which is closed once it's done
+func openTestStore(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set("dataFile", filepath.Join(dir, "images.db"))
+	viper.Set("secretKey", "test")
+	if err := openStore(viper.GetString("dataFile"), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeStore()
+		store = nil
+	})
+}
+
+// fakeGraphAPI serves an account's media newest first from the parts of the Instagram Graph API the
+// provider uses
+type fakeGraphAPI struct {
+	sync.Mutex
+	media []instagramMedia
+	*httptest.Server
+}
+
+func newFakeGraphAPI(t *testing.T) *fakeGraphAPI {
+	f := &fakeGraphAPI{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh_access_token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "refreshed", "expires_in": 5184000})
+	})
+	mux.HandleFunc("/me/media", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("access_token") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"message": "missing token", "type": "OAuthException", "code": 190}}`)
+			return
+		}
+		f.Lock()
+		defer f.Unlock()
+		// cursors are the id of the last media on the page, so they stay put as new media is posted
+		start := 0
+		for m := range f.media {
+			if f.media[m].ID == r.FormValue("after") {
+				start = m + 1
+			}
+		}
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		end := start + limit
+		if end > len(f.media) {
+			end = len(f.media)
+		}
+		page := instagramMediaPage{Data: f.media[start:end]}
+		if end < len(f.media) {
+			page.Paging.Cursors.After = f.media[end-1].ID
+			page.Paging.Next = f.URL + "/me/media?after=" + page.Paging.Cursors.After
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/file/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		fmt.Fprint(w, strings.TrimPrefix(r.URL.Path, "/file/"))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// post adds media to the account, which is newer than what's already there
+func (f *fakeGraphAPI) post(media ...instagramMedia) {
+	f.Lock()
+	defer f.Unlock()
+	f.media = append(media, f.media...)
+}
+
+func (f *fakeGraphAPI) image(id string) instagramMedia {
+	return instagramMedia{ID: id, MediaType: "IMAGE", MediaURL: f.URL + "/file/" + id,
+		Timestamp: time.Now().Format(instagramTimeFormat)}
+}
+
+func pollTestInstagram(t *testing.T, i *instagram) []string {
+	t.Helper()
+	images, err := i.getImages(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = addImages(images); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(images))
+	for k := range images {
+		keys[k] = images[k].Key
+	}
+	return keys
+}
+
+func TestInstagramAPIBacklog(t *testing.T) {
+	openTestStore(t)
+	api := newFakeGraphAPI(t)
+
+	// a carousel is cut short by maxImagesPerPoll
+	for n := 0; n < maxImagesPerPoll+10; n++ {
+		if n == maxImagesPerPoll-2 {
+			album := instagramMedia{ID: "album", MediaType: "CAROUSEL_ALBUM",
+				Timestamp: time.Now().Format(instagramTimeFormat)}
+			for c := 0; c < 4; c++ {
+				album.Children.Data = append(album.Children.Data, api.image(fmt.Sprintf("child%d", c)))
+			}
+			api.media = append(api.media, album)
+			continue
+		}
+		api.media = append(api.media, api.image(fmt.Sprintf("old%d", n)))
+	}
+	i := &instagram{accessToken: "token", userID: "me", apiURL: api.URL}
+
+	first := pollTestInstagram(t, i)
+	if len(first) != maxImagesPerPoll {
+		t.Fatalf("Expected the first poll to stop at %d images, got %d", maxImagesPerPoll, len(first))
+	}
+	if first[len(first)-1] != "instagram.child1" {
+		t.Fatalf("Expected the first poll to stop part way through the carousel, stopped at %s",
+			first[len(first)-1])
+	}
+
+	// new media is imported before the backlog
+	api.post(api.image("new"))
+	second := pollTestInstagram(t, i)
+	if len(second) != 14 || second[0] != "instagram.new" || second[1] != "instagram.child2" {
+		t.Fatalf("Expected the new image then the rest of the backlog, got %v", second)
+	}
+
+	if third := pollTestInstagram(t, i); len(third) != 0 {
+		t.Fatalf("Expected nothing new, got %v", third)
+	}
+
+	count, err := store.Count(&image{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != maxImagesPerPoll+14 {
+		t.Fatalf("Expected every image to be imported once, %d were imported", count)
+	}
+	if err = store.Get("instagram.backlog.me", &instagramBacklog{}); err == nil {
+		t.Fatal("Expected the backlog to be cleared once it was imported")
+	}
+}
+
+func TestInstagramAPIStopsAtImported(t *testing.T) {
+	openTestStore(t)
+	api := newFakeGraphAPI(t)
+	api.post(api.image("1"), api.image("2"))
+	i := &instagram{accessToken: "token", userID: "me", apiURL: api.URL}
+
+	if got := pollTestInstagram(t, i); len(got) != 2 {
+		t.Fatalf("Expected 2 images, got %v", got)
+	}
+	// removed images aren't imported again, everything older than the newest imported image is skipped
+	if err := deleteImage("instagram.2"); err != nil {
+		t.Fatal(err)
+	}
+	api.post(api.image("3"))
+	if got := pollTestInstagram(t, i); len(got) != 1 || got[0] != "instagram.3" {
+		t.Fatalf("Expected only the new image, got %v", got)
+	}
+}
@@ -8,9 +8,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
 )
 
 func init() {
@@ -37,9 +37,36 @@ func main() {
 	viper.SetDefault("port", "8080")
 	viper.SetDefault("imageCycleDuration", "5s")
 	viper.SetDefault("maxImageCount", 1000)
+	viper.SetDefault("maxStorageSize", "")
+	viper.SetDefault("evictionPolicy", evictOldest)
+	viper.SetDefault("unratedRating", 3)
 	viper.SetDefault("newImagePollDuration", "1h")
 	viper.SetDefault("dataFile", "./images.db")
+	viper.SetDefault("tls.acme.directoryURL", acme.LetsEncryptURL)
 	viper.SetDefault("imageOrder", "default")
+	viper.SetDefault("eventGap", "12h")
+	viper.SetDefault("eventDistance", 100.0)
+	viper.SetDefault("storyTitles", true)
+	viper.SetDefault("transition", transitionCrossfade)
+	viper.SetDefault("transitionDuration", "2s")
+	viper.SetDefault("pairImages", true)
+	viper.SetDefault("fit", fitContain)
+	viper.SetDefault("faces.minQuality", 5.0)
+	viper.SetDefault("showPlace", false)
+	viper.SetDefault("favoriteWeight", 3)
+	viper.SetDefault("ratingWeight", 0.5)
+	viper.SetDefault("heifCommand", []string{"heif-convert", "-q", "90", "{input}", "{output}"})
+
+	name := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -47,22 +74,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = openStore(viper.GetString("dataFile"))
-	if err != nil {
-		log.Printf("Error opening data file: %s \n", err)
+	if errs := loadConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		log.Printf("Invalid config file %s, found %d errors \n", viper.ConfigFileUsed(), len(errs))
 		os.Exit(1)
-
 	}
 
-	initializeProviders(viper.GetString("newImagePollDuration"), viper.GetStringMap("providers"))
-	imageDuration, err := time.ParseDuration(viper.GetString("imageCycleDuration"))
-	if err != nil {
-		imageDuration = 3 * time.Second
+	if !cmd.noStore {
+		err = openStore(viper.GetString("dataFile"), cmd.readOnly)
+		if err != nil {
+			log.Printf("Error opening data file: %s \n", err)
+			os.Exit(1)
+		}
+		defer closeStore()
+		if !cmd.readOnly {
+			if err = recordStoredImages(); err != nil {
+				log.Printf("Error recording the size of stored images: %s \n", err)
+				closeStore()
+				os.Exit(1)
+			}
+		}
 	}
-	err = startServer(viper.GetString("port"), imageDuration, newQueue(viper.GetInt("maxImageCount"),
-		viper.GetString("imageOrder")))
+
+	err = cmd.run(args)
 	if err != nil {
-		log.Printf("Error starting server: %s \n", err)
+		log.Printf("Error running %s: %s \n", name, err)
+		closeStore()
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,171 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mboxReader splits an mbox file into its individual messages
+type mboxReader struct {
+	r         *bufio.Reader
+	inMessage bool
+}
+
+func newMboxReader(r io.Reader) *mboxReader {
+	return &mboxReader{r: bufio.NewReader(r)}
+}
+
+// next returns the next raw message in the mbox, or io.EOF if there are no more messages
+func (m *mboxReader) next() ([]byte, error) {
+	var msg bytes.Buffer
+	for {
+		line, err := m.r.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("From ")) {
+				// separator line, the start of the next message
+				if m.inMessage && msg.Len() > 0 {
+					return msg.Bytes(), nil
+				}
+				m.inMessage = true
+				continue
+			}
+			if m.inMessage {
+				// lines starting with From in the body are escaped with a leading >
+				if line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+					line = line[1:]
+				}
+				msg.Write(line)
+			}
+		}
+		if err == io.EOF {
+			if msg.Len() > 0 {
+				return msg.Bytes(), nil
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// syncMbox imports the images from all messages in the mbox file after the last one processed.
+// mbox files are only ever appended to, so the number of messages processed is enough to track
+// which are new
+func (e *email) syncMbox(found func(images []*image) error) error {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	state, err := e.state()
+	if err != nil {
+		return err
+	}
+
+	var images []*image
+	r := newMboxReader(f)
+	for index := uint32(0); ; index++ {
+		raw, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if index < state.LastUID {
+			continue
+		}
+
+		imgs, err := e.imagesFromMessage(fmt.Sprintf("%s.%d", e.path, index), bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		images = append(images, imgs...)
+		state.LastUID = index + 1
+
+		if len(images) >= maxImagesPerPoll {
+			if err = e.flush(images, state, found); err != nil {
+				return err
+			}
+			images = nil
+		}
+	}
+
+	return e.flush(images, state, found)
+}
+
+// syncMaildir imports the images from all messages in the maildir's new and cur directories that
+// haven't been seen before
+func (e *email) syncMaildir(found func(images []*image) error) error {
+	state, err := e.state()
+	if err != nil {
+		return err
+	}
+
+	// the unique part of a maildir filename is before the flags, which can change
+	files := make(map[string]string)
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(e.path, dir))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			unique := strings.SplitN(entry.Name(), ":", 2)[0]
+			files[unique] = filepath.Join(e.path, dir, entry.Name())
+		}
+	}
+
+	for unique := range state.Seen {
+		if _, ok := files[unique]; !ok {
+			delete(state.Seen, unique)
+		}
+	}
+
+	uniques := make([]string, 0, len(files))
+	for unique := range files {
+		if !state.Seen[unique] {
+			uniques = append(uniques, unique)
+		}
+	}
+	// unique names start with the delivery time
+	sort.Strings(uniques)
+
+	var images []*image
+	for _, unique := range uniques {
+		f, err := os.Open(files[unique])
+		if err != nil {
+			return err
+		}
+		imgs, err := e.imagesFromMessage(fmt.Sprintf("%s.%s", e.path, unique), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		images = append(images, imgs...)
+		state.Seen[unique] = true
+
+		if len(images) >= maxImagesPerPoll {
+			if err = e.flush(images, state, found); err != nil {
+				return err
+			}
+			images = nil
+		}
+	}
+
+	return e.flush(images, state, found)
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func readTestMbox(t *testing.T, mbox string) []string {
+	t.Helper()
+	r := newMboxReader(strings.NewReader(mbox))
+	var messages []string
+	for {
+		msg, err := r.next()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(msg))
+	}
+}
+
+func TestMboxSplit(t *testing.T) {
+	messages := readTestMbox(t, "From family@example.com Sat Jan  4 10:00:00 2020\n"+
+		"Subject: one\n\nfirst\n\n"+
+		"From family@example.com Sun Jan  5 10:00:00 2020\n"+
+		"Subject: two\n\nsecond\n"+
+		"From family@example.com Mon Jan  6 10:00:00 2020\n"+
+		"Subject: three\n\nwithout a trailing newline")
+
+	expected := []string{
+		"Subject: one\n\nfirst\n\n",
+		"Subject: two\n\nsecond\n",
+		"Subject: three\n\nwithout a trailing newline",
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d: %q", len(expected), len(messages), messages)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Fatalf("Expected message %d to be %q, got %q", i, expected[i], messages[i])
+		}
+	}
+}
+
+func TestMboxEscapedFrom(t *testing.T) {
+	messages := readTestMbox(t, "From family@example.com Sat Jan  4 10:00:00 2020\n"+
+		"Subject: escaped\n\n"+
+		">From the beach\n"+
+		">>From a quoted reply\n"+
+		">not escaped\n"+
+		"From: isn't a separator without the space\n")
+
+	expected := "Subject: escaped\n\n" +
+		"From the beach\n" +
+		">From a quoted reply\n" +
+		">not escaped\n" +
+		"From: isn't a separator without the space\n"
+	if len(messages) != 1 || messages[0] != expected {
+		t.Fatalf("Expected one message with From lines unescaped, got %q", messages)
+	}
+}
+
+func TestMboxEmpty(t *testing.T) {
+	if messages := readTestMbox(t, ""); len(messages) != 0 {
+		t.Fatalf("Expected no messages, got %q", messages)
+	}
+}
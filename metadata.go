@@ -0,0 +1,105 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	goimage "image"
+	_ "image/gif" // decoders for measuring images
+	_ "image/png"
+	"log"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	bh "github.com/timshannon/bolthold"
+	_ "golang.org/x/image/webp"
+)
+
+// image orientations
+const (
+	orientationUnknown   = ""
+	orientationLandscape = "landscape"
+	orientationPortrait  = "portrait"
+)
+
+// exifDate returns when a photo was taken from its EXIF data
+func exifDate(data []byte) (time.Time, bool) {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return time.Time{}, false
+	}
+	date, err := x.DateTime()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// imageDimensions returns the size of an image as it is displayed, browsers rotate images by their
+// EXIF orientation, so rotated images have their width and height swapped
+func imageDimensions(data []byte) (int, int, bool) {
+	config, _, err := goimage.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// orientations 5 to 8 are rotated a quarter turn
+	if o := exifOrientation(data); o >= 5 && o <= 8 {
+		return config.Height, config.Width, true
+	}
+	return config.Width, config.Height, true
+}
+
+// exifOrientation returns an image's EXIF orientation, 1 if it has none
+func exifOrientation(data []byte) int {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// measure sets an image's dimensions if they haven't been
+func (i *image) measure() {
+	if i.Width != 0 || i.isVideo() {
+		return
+	}
+	i.Width, i.Height, _ = imageDimensions(i.Data)
+}
+
+func (i *image) orientation() string {
+	switch {
+	case i.Width == 0 || i.Height == 0:
+		return orientationUnknown
+	case i.Height > i.Width:
+		return orientationPortrait
+	}
+	return orientationLandscape
+}
+
+// measureStoredImages sets the dimensions of images stored before they were measured
+func measureStoredImages() {
+	keys, err := imageKeys(bh.Where("Width").Eq(0).And("Kind").Ne(kindVideo))
+	if err != nil {
+		log.Printf("Error finding images to measure: %s\n", err)
+		return
+	}
+
+	for _, key := range keys {
+		err = updateImage(key, func(img *image) {
+			img.measure()
+		})
+		if err != nil {
+			log.Printf("Error storing dimensions of %s: %s\n", key, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	bh "github.com/timshannon/bolthold"
+	"go.etcd.io/bbolt"
+)
+
+const metricsNamespace = "photo_frame"
+
+var (
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_poll_duration_seconds",
+		Help:      "How long polling a provider for new images took.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+	}, []string{"provider"})
+	imagesFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_images_fetched_total",
+		Help:      "Images fetched from a provider.",
+	}, []string{"provider"})
+	providerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_errors_total",
+		Help:      "Failed polls or connections to a provider.",
+	}, []string{"provider"})
+	providerLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "provider_last_success_timestamp_seconds",
+		Help:      "When a provider was last polled successfully.",
+	}, []string{"provider"})
+	storedImages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "images",
+		Help:      "Images stored from a provider.",
+	}, []string{"provider"})
+	storedImageBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_bytes",
+		Help:      "Size of the images stored from a provider.",
+	}, []string{"provider"})
+	queueRepopulations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_repopulations_total",
+		Help:      "Times the image queue was rebuilt from the store.",
+	})
+	imagesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_images_served_total",
+		Help:      "Images shown by a display's session.",
+	}, []string{"session"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of http requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+	storeSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "store_size_bytes",
+		Help:      "Size of the data file.",
+	}, func() float64 {
+		var size int64
+		err := store.Bolt().View(func(tx *bbolt.Tx) error {
+			size = tx.Size()
+			return nil
+		})
+		if err != nil {
+			return 0
+		}
+		return float64(size)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(pollDuration, imagesFetched, providerErrors, providerLastSuccess, storedImages,
+		storedImageBytes, queueRepopulations, imagesServed, httpDuration, storeSize)
+}
+
+// providerHealth is the result of the latest poll or connection of each provider
+var providerHealth = struct {
+	sync.Mutex
+	errors map[string]error
+}{
+	errors: make(map[string]error),
+}
+
+// recordProviderResult tracks a provider's health, err is nil if the provider was reached successfully
+func recordProviderResult(provider string, err error) {
+	providerHealth.Lock()
+	providerHealth.errors[provider] = err
+	providerHealth.Unlock()
+
+	if err != nil {
+		providerErrors.WithLabelValues(provider).Inc()
+		return
+	}
+	providerLastSuccess.WithLabelValues(provider).SetToCurrentTime()
+}
+
+// setStoreMetrics updates the stored image gauges with the count and size of each provider's images
+func setStoreMetrics(counts map[string]int, usage map[string]int64) {
+	storedImages.Reset()
+	storedImageBytes.Reset()
+	for provider, count := range counts {
+		storedImages.WithLabelValues(provider).Set(float64(count))
+		storedImageBytes.WithLabelValues(provider).Set(float64(usage[provider]))
+	}
+}
+
+// refreshStoreMetrics reads the stored image gauges from the store, they are kept up to date
+// afterwards as images are added
+func refreshStoreMetrics() {
+	var images []*stored
+	err := store.Find(&images, bh.Where("Hidden").Eq(false))
+	if err != nil {
+		log.Printf("Error reading images for metrics: %s\n", err)
+		return
+	}
+	counts := make(map[string]int)
+	usage := make(map[string]int64)
+	for _, img := range images {
+		counts[img.Provider]++
+		usage[img.Provider] += img.Size + img.Variants
+	}
+	setStoreMetrics(counts, usage)
+}
+
+// sessionLabel identifies a session in metrics without exposing its cookie
+func sessionLabel(id string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(id)))[:8]
+}
+
+// instrument records the latency of every request by the pattern of the handler that served it
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "/events" {
+			// event streams stay open as long as the page, so their latency means nothing
+			mux.ServeHTTP(w, r)
+			return
+		}
+		promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(prometheus.Labels{"handler": pattern}),
+			mux).ServeHTTP(w, r)
+	})
+}
+
+// healthy returns an error if the store can't be read
+func healthy() error {
+	return store.Bolt().View(func(tx *bbolt.Tx) error { return nil })
+}
+
+// ready returns an error if the store can't be read, or a provider's latest poll failed
+func ready() error {
+	err := healthy()
+	if err != nil {
+		return err
+	}
+
+	providerHealth.Lock()
+	defer providerHealth.Unlock()
+	for provider, err := range providerHealth.errors {
+		if err != nil {
+			return fmt.Errorf("Provider %s is failing: %s", provider, err)
+		}
+	}
+	return nil
+}
+
+// healthCheck serves the result of a health check
+func healthCheck(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"golang.org/x/oauth2"
+)
+
+// oauth providers with known endpoints, any other provider needs its endpoints configured
+const (
+	oauthGoogle    = "google"
+	oauthMicrosoft = "microsoft"
+)
+
+// SASL mechanisms for authenticating with an OAuth2 access token
+const (
+	mechanismXOAuth2     = "XOAUTH2"
+	mechanismOAuthBearer = "OAUTHBEARER"
+)
+
+type oauthConfig struct {
+	Provider      string   `config:"provider"`
+	Tenant        string   `config:"tenant"` // microsoft only
+	ClientID      string   `config:"clientID"`
+	ClientSecret  secret   `config:"clientSecret"`
+	DeviceAuthURL string   `config:"deviceAuthURL"`
+	TokenURL      string   `config:"tokenURL"`
+	Scopes        []string `config:"scopes"`
+	Mechanism     string   `config:"mechanism"`
+}
+
+// configured returns whether any oauth settings have been set
+func (o oauthConfig) configured() bool {
+	return o.Provider != "" || o.ClientID != "" || o.DeviceAuthURL != "" || o.TokenURL != ""
+}
+
+// oauthClient gets access tokens for a mail account, which is authorized once with the device flow
+// by a person signing in on another device
+type oauthClient struct {
+	key       string // store key of the account's token
+	config    *oauth2.Config
+	mechanism string
+}
+
+// oauthToken is an account's token, sealed since the refresh token grants access to the mailbox
+type oauthToken struct {
+	Key    string `boltholdKey:"Key"`
+	Sealed sealed
+}
+
+// newOAuthClient returns the oauth client for the settings in the key of a config section
+func newOAuthClient(config *configSection, key, account string, settings oauthConfig) (*oauthClient, error) {
+	var errs configErrors
+	endpoint := oauth2.Endpoint{DeviceAuthURL: settings.DeviceAuthURL, TokenURL: settings.TokenURL}
+	scopes := settings.Scopes
+
+	switch settings.Provider {
+	case oauthGoogle:
+		endpoint = oauth2.Endpoint{
+			AuthURL:       "https://accounts.google.com/o/oauth2/auth",
+			DeviceAuthURL: "https://oauth2.googleapis.com/device/code",
+			TokenURL:      "https://oauth2.googleapis.com/token",
+		}
+		if len(scopes) == 0 {
+			scopes = []string{"https://mail.google.com/"}
+		}
+	case oauthMicrosoft:
+		tenant := settings.Tenant
+		if tenant == "" {
+			tenant = "common"
+		}
+		base := "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0"
+		endpoint = oauth2.Endpoint{
+			AuthURL:       base + "/authorize",
+			DeviceAuthURL: base + "/devicecode",
+			TokenURL:      base + "/token",
+		}
+		if len(scopes) == 0 {
+			scopes = []string{"https://outlook.office.com/IMAP.AccessAsUser.All", "offline_access"}
+		}
+	case "":
+		if endpoint.DeviceAuthURL == "" || endpoint.TokenURL == "" {
+			errs = append(errs, config.errorf(key, "deviceAuthURL and tokenURL are required without a provider"))
+		}
+	default:
+		errs = append(errs, config.errorf(key+".provider", "must be %s, %s or blank, not %q", oauthGoogle,
+			oauthMicrosoft, settings.Provider))
+	}
+	if settings.ClientID == "" {
+		errs = append(errs, config.errorf(key+".clientID", "required"))
+	}
+
+	mechanism := strings.ToUpper(settings.Mechanism)
+	switch mechanism {
+	case "":
+		mechanism = mechanismXOAuth2
+	case mechanismXOAuth2, mechanismOAuthBearer:
+	default:
+		errs = append(errs, config.errorf(key+".mechanism", "must be %s or %s, not %q", mechanismXOAuth2,
+			mechanismOAuthBearer, settings.Mechanism))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &oauthClient{
+		key: "oauth:" + account,
+		config: &oauth2.Config{
+			ClientID:     settings.ClientID,
+			ClientSecret: string(settings.ClientSecret),
+			Endpoint:     endpoint,
+			Scopes:       scopes,
+		},
+		mechanism: mechanism,
+	}, nil
+}
+
+// oauth2Config returns a copy of the client's config, whose secret is replaced when the config is reloaded
+func (o *oauthClient) oauth2Config() *oauth2.Config {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	config := *o.config
+	return &config
+}
+
+// authorize runs the device flow, prompt is passed where and with what code the person authorizing
+// should sign in, and authorize returns once they have
+func (o *oauthClient) authorize(ctx context.Context, prompt func(auth *oauth2.DeviceAuthResponse)) error {
+	auth, err := o.oauth2Config().DeviceAuth(ctx)
+	if err != nil {
+		return err
+	}
+	prompt(auth)
+
+	token, err := o.oauth2Config().DeviceAccessToken(ctx, auth)
+	if err != nil {
+		return err
+	}
+	return o.saveToken(token)
+}
+
+// token returns a current access token, refreshing it and storing the refreshed token if it has expired
+func (o *oauthClient) token() (*oauth2.Token, error) {
+	err := o.storePending()
+	if err != nil {
+		return nil, err
+	}
+	stored := &oauthToken{}
+	err = store.Get(o.key, stored)
+	if err == bh.ErrNotFound {
+		return nil, fmt.Errorf("Account has not been authorized, run the authorize command")
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := stored.Sealed.open()
+	if err != nil {
+		return nil, err
+	}
+	current := &oauth2.Token{}
+	if err = json.Unmarshal([]byte(value), current); err != nil {
+		return nil, err
+	}
+
+	token, err := o.oauth2Config().TokenSource(context.Background(), current).Token()
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken != current.AccessToken {
+		if err = o.saveToken(token); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// saveToken stores a token, or if the data file isn't open because the frame is running, leaves it next
+// to the data file for the frame to store the next time it needs a token
+func (o *oauthClient) saveToken(token *oauth2.Token) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	t := &oauthToken{Key: o.key}
+	t.Sealed, err = seal(string(value))
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return ioutil.WriteFile(o.pendingFile(), t.Sealed, 0600)
+	}
+	return store.Upsert(o.key, t)
+}
+
+// pendingFile is where a token authorized while the frame is running is left for it
+func (o *oauthClient) pendingFile() string {
+	return filepath.Join(filepath.Dir(viper.GetString("dataFile")),
+		fmt.Sprintf("authorized-%x.token", sha256.Sum256([]byte(o.key))))
+}
+
+// storePending stores a token authorized while the frame was running, if there is one
+func (o *oauthClient) storePending() error {
+	file := o.pendingFile()
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = store.Upsert(o.key, &oauthToken{Key: o.key, Sealed: data})
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// saslClient returns a SASL client authenticating the user with a current access token
+func (o *oauthClient) saslClient(username string) (sasl.Client, error) {
+	token, err := o.token()
+	if err != nil {
+		return nil, err
+	}
+	if o.mechanism == mechanismOAuthBearer {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: username,
+			Token:    token.AccessToken,
+		}), nil
+	}
+	return &xoauth2Client{username: username, token: token.AccessToken}, nil
+}
+
+// xoauth2Client implements Google's and Microsoft's XOAUTH2 SASL mechanism, which came before the
+// OAUTHBEARER standard
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (x *xoauth2Client) Start() (string, []byte, error) {
+	return mechanismXOAuth2, []byte("user=" + x.username + "\x01auth=Bearer " + x.token + "\x01\x01"), nil
+}
+
+// Next is only called with an error, which the server expects an empty response to before it fails
+// the authentication
+func (x *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// authorizer is implemented by providers which need to be authorized by someone signing in
+type authorizer interface {
+	authorizing() bool
+	authorize(ctx context.Context, prompt func(auth *oauth2.DeviceAuthResponse)) error
+}
+
+// providerAuthorizer returns the named provider if it needs to be authorized
+func providerAuthorizer(name string) (authorizer, error) {
+	for _, p := range providers {
+		if p.name() != name {
+			continue
+		}
+		if a, ok := p.(authorizer); ok && a.authorizing() {
+			return a, nil
+		}
+		return nil, fmt.Errorf("Provider %s isn't configured to be authorized", name)
+	}
+	return nil, fmt.Errorf("Provider %s is not configured", name)
+}
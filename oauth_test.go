@@ -0,0 +1,288 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenEndpoint is an oauth2 device authorization and token endpoint, the person authorizing the
+// frame signs in after pending polls
+type fakeTokenEndpoint struct {
+	sync.Mutex
+	pending   int
+	polls     int
+	refreshes int
+	*httptest.Server
+}
+
+func newFakeTokenEndpoint(t *testing.T, pending int) *fakeTokenEndpoint {
+	f := &fakeTokenEndpoint{pending: pending}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      "device",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": "https://example.com/device",
+			"expires_in":       300,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		reply := func(access string) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  access,
+				"token_type":    "Bearer",
+				"refresh_token": "refresh",
+				"expires_in":    3600,
+			})
+		}
+		switch r.FormValue("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if r.FormValue("device_code") != "device" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			f.polls++
+			if f.polls <= f.pending {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+				return
+			}
+			reply("authorized")
+		case "refresh_token":
+			if r.FormValue("refresh_token") != "refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			f.refreshes++
+			reply("refreshed")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+		}
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestOAuthClient(t *testing.T, endpoint *fakeTokenEndpoint) *oauthClient {
+	t.Helper()
+	o, err := newOAuthClient(newConfigSection("providers.email", nil), "oauth2", "frame@imap.example.com",
+		oauthConfig{ClientID: "frame", DeviceAuthURL: endpoint.URL + "/device", TokenURL: endpoint.URL + "/token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOAuthDeviceFlow(t *testing.T) {
+	openTestStore(t)
+	endpoint := newFakeTokenEndpoint(t, 1)
+	o := newTestOAuthClient(t, endpoint)
+
+	var prompted *oauth2.DeviceAuthResponse
+	err := o.authorize(context.Background(), func(auth *oauth2.DeviceAuthResponse) {
+		prompted = auth
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompted == nil || prompted.UserCode != "ABCD-EFGH" {
+		t.Fatalf("Expected to be prompted with the user code, got %+v", prompted)
+	}
+	if endpoint.polls <= endpoint.pending {
+		t.Fatalf("Expected polling to carry on while authorization was pending, polled %d times", endpoint.polls)
+	}
+
+	token, err := o.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "authorized" || endpoint.refreshes != 0 {
+		t.Fatalf("Expected the stored token without refreshing it, got %s after %d refreshes", token.AccessToken,
+			endpoint.refreshes)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+	openTestStore(t)
+	endpoint := newFakeTokenEndpoint(t, 0)
+	o := newTestOAuthClient(t, endpoint)
+
+	if _, err := o.token(); err == nil {
+		t.Fatal("Expected an error before the account is authorized")
+	}
+
+	err := o.saveToken(&oauth2.Token{AccessToken: "expired", RefreshToken: "refresh",
+		Expiry: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := o.token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "refreshed" {
+			t.Fatalf("Expected the refreshed token, got %s", token.AccessToken)
+		}
+	}
+	if endpoint.refreshes != 1 {
+		t.Fatalf("Expected the refreshed token to be stored and used again, refreshed %d times", endpoint.refreshes)
+	}
+
+	stored := &oauthToken{}
+	if err = store.Get(o.key, stored); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored.Sealed, []byte("refresh")) {
+		t.Fatal("Expected the stored token to be sealed")
+	}
+}
+
+func TestOAuthAuthorizeWhileRunning(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "images.db")
+	viper.Set("dataFile", file)
+	viper.Set("secretKey", "test")
+	endpoint := newFakeTokenEndpoint(t, 0)
+	o := newTestOAuthClient(t, endpoint)
+
+	// the authorize command doesn't have the data file open while the frame is running
+	err := o.authorize(context.Background(), func(auth *oauth2.DeviceAuthResponse) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(o.pendingFile()); err != nil {
+		t.Fatalf("Expected the token to be left for the frame: %s", err)
+	}
+
+	if err = openStore(file, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeStore()
+		store = nil
+	})
+	token, err := o.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "authorized" {
+		t.Fatalf("Expected the token authorized while running, got %s", token.AccessToken)
+	}
+	if _, err = os.Stat(o.pendingFile()); !os.IsNotExist(err) {
+		t.Fatal("Expected the token left for the frame to be removed once it's stored")
+	}
+}
+
+// xoauth2Server accepts XOAUTH2 authentication with a bearer token for the memory backend's user
+type xoauth2Server struct {
+	conn  server.Conn
+	token string
+}
+
+func (x *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if !bytes.Equal(response, []byte("user=username\x01auth=Bearer "+x.token+"\x01\x01")) {
+		return nil, true, errors.New("Invalid token")
+	}
+	user, err := memory.New().Login(x.conn.Info(), "username", "password")
+	if err != nil {
+		return nil, true, err
+	}
+	ctx := x.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
+
+func newFakeIMAPServer(t *testing.T, token string) string {
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.ErrorLog = nopLogger{}
+	s.EnableAuth(mechanismXOAuth2, func(conn server.Conn) sasl.Server {
+		return &xoauth2Server{conn: conn, token: token}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
+
+func TestOAuthIMAP(t *testing.T) {
+	openTestStore(t)
+	endpoint := newFakeTokenEndpoint(t, 0)
+	o := newTestOAuthClient(t, endpoint)
+	addr := newFakeIMAPServer(t, "refreshed")
+
+	authenticate := func() error {
+		c, err := client.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Logout()
+		auth, err := o.saslClient("username")
+		if err != nil {
+			return err
+		}
+		if err = c.Authenticate(auth); err != nil {
+			return err
+		}
+		_, err = c.Select("INBOX", false)
+		return err
+	}
+
+	err := o.saveToken(&oauth2.Token{AccessToken: "revoked", RefreshToken: "refresh",
+		Expiry: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authenticate(); err == nil {
+		t.Fatal("Expected a token the server doesn't accept to fail")
+	}
+
+	// expired tokens are refreshed before authenticating
+	err = o.saveToken(&oauth2.Token{AccessToken: "expired", RefreshToken: "refresh",
+		Expiry: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authenticate(); err != nil {
+		t.Fatal(err)
+	}
+}
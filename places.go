@@ -0,0 +1,590 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+// bundledPlaces are major cities, so images get a place name without any download.  Each line is the
+// city's name, its country's ISO 3166 code, and its latitude and longitude
+const bundledPlaces = `
+Tokyo	JP	35.68	139.69
+Yokohama	JP	35.44	139.64
+Osaka	JP	34.69	135.50
+Kyoto	JP	35.01	135.77
+Nagoya	JP	35.18	136.91
+Sapporo	JP	43.06	141.35
+Fukuoka	JP	33.59	130.40
+Hiroshima	JP	34.39	132.46
+Sendai	JP	38.27	140.87
+Naha	JP	26.21	127.68
+Kobe	JP	34.69	135.20
+Nara	JP	34.69	135.80
+Kanazawa	JP	36.56	136.66
+Niigata	JP	37.92	139.04
+Kagoshima	JP	31.60	130.56
+Nagano	JP	36.65	138.19
+Matsuyama	JP	33.84	132.77
+Hakodate	JP	41.77	140.73
+Beijing	CN	39.90	116.41
+Shanghai	CN	31.23	121.47
+Guangzhou	CN	23.13	113.26
+Shenzhen	CN	22.54	114.06
+Chengdu	CN	30.57	104.07
+Chongqing	CN	29.56	106.55
+Xi'an	CN	34.34	108.94
+Wuhan	CN	30.59	114.31
+Hangzhou	CN	30.27	120.16
+Nanjing	CN	32.06	118.80
+Tianjin	CN	39.34	117.36
+Harbin	CN	45.80	126.53
+Kunming	CN	25.04	102.71
+Lhasa	CN	29.65	91.17
+Urumqi	CN	43.83	87.62
+Shenyang	CN	41.81	123.43
+Qingdao	CN	36.07	120.38
+Xiamen	CN	24.48	118.09
+Guilin	CN	25.27	110.29
+Lanzhou	CN	36.06	103.83
+Hohhot	CN	40.84	111.75
+Hong Kong	HK	22.32	114.17
+Macau	MO	22.20	113.54
+Taipei	TW	25.03	121.57
+Kaohsiung	TW	22.63	120.30
+Seoul	KR	37.57	126.98
+Busan	KR	35.18	129.08
+Jeju	KR	33.50	126.53
+Incheon	KR	37.46	126.71
+Daegu	KR	35.87	128.60
+Pyongyang	KP	39.04	125.76
+Ulaanbaatar	MN	47.89	106.91
+Bangkok	TH	13.76	100.50
+Chiang Mai	TH	18.79	98.98
+Phuket	TH	7.88	98.39
+Hanoi	VN	21.03	105.85
+Ho Chi Minh City	VN	10.82	106.63
+Da Nang	VN	16.05	108.22
+Phnom Penh	KH	11.56	104.92
+Siem Reap	KH	13.36	103.86
+Vientiane	LA	17.97	102.63
+Yangon	MM	16.87	96.20
+Kuala Lumpur	MY	3.14	101.69
+Kota Kinabalu	MY	5.98	116.07
+Singapore	SG	1.35	103.82
+Jakarta	ID	-6.21	106.85
+Denpasar	ID	-8.65	115.22
+Surabaya	ID	-7.25	112.75
+Yogyakarta	ID	-7.80	110.36
+Manila	PH	14.60	120.98
+Cebu	PH	10.32	123.89
+Bandar Seri Begawan	BN	4.89	114.94
+Dili	TL	-8.56	125.56
+Delhi	IN	28.61	77.21
+Mumbai	IN	19.08	72.88
+Bangalore	IN	12.97	77.59
+Chennai	IN	13.08	80.27
+Kolkata	IN	22.57	88.36
+Hyderabad	IN	17.39	78.49
+Jaipur	IN	26.91	75.79
+Agra	IN	27.18	78.01
+Panaji	IN	15.50	73.83
+Kochi	IN	9.93	76.27
+Varanasi	IN	25.32	82.97
+Ahmedabad	IN	23.02	72.57
+Karachi	PK	24.86	67.01
+Lahore	PK	31.55	74.34
+Islamabad	PK	33.68	73.05
+Dhaka	BD	23.81	90.41
+Kathmandu	NP	27.72	85.32
+Colombo	LK	6.93	79.86
+Thimphu	BT	27.47	89.64
+Malé	MV	4.18	73.51
+Kabul	AF	34.56	69.21
+Tashkent	UZ	41.30	69.24
+Samarkand	UZ	39.65	66.96
+Almaty	KZ	43.24	76.89
+Astana	KZ	51.17	71.45
+Bishkek	KG	42.87	74.59
+Dushanbe	TJ	38.56	68.79
+Ashgabat	TM	37.96	58.33
+Tehran	IR	35.69	51.39
+Isfahan	IR	32.65	51.67
+Baghdad	IQ	33.31	44.36
+Riyadh	SA	24.71	46.68
+Jeddah	SA	21.49	39.19
+Dubai	AE	25.20	55.27
+Abu Dhabi	AE	24.45	54.38
+Doha	QA	25.29	51.53
+Manama	BH	26.23	50.59
+Kuwait City	KW	29.38	47.99
+Muscat	OM	23.59	58.41
+Sana'a	YE	15.37	44.19
+Amman	JO	31.95	35.93
+Tel Aviv	IL	32.09	34.78
+Beirut	LB	33.89	35.50
+Damascus	SY	33.51	36.28
+Istanbul	TR	41.01	28.98
+Ankara	TR	39.93	32.86
+Izmir	TR	38.42	27.14
+Antalya	TR	36.90	30.70
+Nicosia	CY	35.19	33.38
+Tbilisi	GE	41.72	44.79
+Yerevan	AM	40.18	44.51
+Baku	AZ	40.41	49.87
+London	GB	51.51	-0.13
+Manchester	GB	53.48	-2.24
+Birmingham	GB	52.49	-1.89
+Edinburgh	GB	55.95	-3.19
+Glasgow	GB	55.86	-4.25
+Cardiff	GB	51.48	-3.18
+Belfast	GB	54.60	-5.93
+Bristol	GB	51.45	-2.59
+Liverpool	GB	53.41	-2.99
+Newcastle upon Tyne	GB	54.98	-1.61
+Inverness	GB	57.48	-4.22
+Dublin	IE	53.35	-6.26
+Cork	IE	51.90	-8.47
+Galway	IE	53.27	-9.05
+Paris	FR	48.86	2.35
+Marseille	FR	43.30	5.37
+Lyon	FR	45.76	4.84
+Nice	FR	43.70	7.27
+Bordeaux	FR	44.84	-0.58
+Toulouse	FR	43.60	1.44
+Strasbourg	FR	48.57	7.75
+Nantes	FR	47.22	-1.55
+Lille	FR	50.63	3.06
+Brest	FR	48.39	-4.49
+Ajaccio	FR	41.92	8.74
+Monaco	MC	43.74	7.42
+Brussels	BE	50.85	4.35
+Antwerp	BE	51.22	4.40
+Amsterdam	NL	52.37	4.90
+Rotterdam	NL	51.92	4.48
+Luxembourg	LU	49.61	6.13
+Berlin	DE	52.52	13.40
+Hamburg	DE	53.55	9.99
+Munich	DE	48.14	11.58
+Cologne	DE	50.94	6.96
+Frankfurt	DE	50.11	8.68
+Stuttgart	DE	48.78	9.18
+Dresden	DE	51.05	13.74
+Leipzig	DE	51.34	12.37
+Hanover	DE	52.38	9.73
+Nuremberg	DE	49.45	11.08
+Bremen	DE	53.08	8.80
+Vienna	AT	48.21	16.37
+Salzburg	AT	47.81	13.04
+Innsbruck	AT	47.27	11.40
+Graz	AT	47.07	15.44
+Zurich	CH	47.38	8.54
+Geneva	CH	46.20	6.14
+Bern	CH	46.95	7.45
+Basel	CH	47.56	7.59
+Lugano	CH	46.00	8.95
+Vaduz	LI	47.14	9.52
+Madrid	ES	40.42	-3.70
+Barcelona	ES	41.39	2.17
+Valencia	ES	39.47	-0.38
+Seville	ES	37.39	-5.98
+Málaga	ES	36.72	-4.42
+Bilbao	ES	43.26	-2.93
+Granada	ES	37.18	-3.60
+Palma	ES	39.57	2.65
+Santiago de Compostela	ES	42.88	-8.54
+Las Palmas	ES	28.12	-15.44
+Santa Cruz de Tenerife	ES	28.46	-16.25
+Zaragoza	ES	41.65	-0.89
+Andorra la Vella	AD	42.51	1.52
+Lisbon	PT	38.72	-9.14
+Porto	PT	41.15	-8.61
+Faro	PT	37.02	-7.93
+Funchal	PT	32.65	-16.91
+Ponta Delgada	PT	37.74	-25.67
+Rome	IT	41.90	12.50
+Milan	IT	45.46	9.19
+Naples	IT	40.85	14.27
+Turin	IT	45.07	7.69
+Florence	IT	43.77	11.26
+Venice	IT	45.44	12.32
+Bologna	IT	44.49	11.34
+Palermo	IT	38.12	13.36
+Catania	IT	37.50	15.09
+Bari	IT	41.12	16.87
+Cagliari	IT	39.22	9.12
+Genoa	IT	44.41	8.93
+Verona	IT	45.44	10.99
+San Marino	SM	43.94	12.45
+Valletta	MT	35.90	14.51
+Athens	GR	37.98	23.73
+Thessaloniki	GR	40.64	22.94
+Heraklion	GR	35.34	25.13
+Fira	GR	36.42	25.43
+Rhodes	GR	36.43	28.22
+Corfu	GR	39.62	19.92
+Copenhagen	DK	55.68	12.57
+Aarhus	DK	56.16	10.20
+Oslo	NO	59.91	10.75
+Bergen	NO	60.39	5.32
+Trondheim	NO	63.43	10.40
+Tromsø	NO	69.65	18.96
+Stavanger	NO	58.97	5.73
+Stockholm	SE	59.33	18.07
+Gothenburg	SE	57.71	11.97
+Malmö	SE	55.60	13.00
+Kiruna	SE	67.86	20.23
+Umeå	SE	63.83	20.26
+Helsinki	FI	60.17	24.94
+Rovaniemi	FI	66.50	25.73
+Tampere	FI	61.50	23.76
+Turku	FI	60.45	22.27
+Reykjavík	IS	64.15	-21.94
+Akureyri	IS	65.68	-18.09
+Tórshavn	FO	62.01	-6.77
+Tallinn	EE	59.44	24.75
+Riga	LV	56.95	24.11
+Vilnius	LT	54.69	25.28
+Warsaw	PL	52.23	21.01
+Kraków	PL	50.06	19.94
+Gdańsk	PL	54.35	18.65
+Wrocław	PL	51.11	17.04
+Poznań	PL	52.41	16.93
+Prague	CZ	50.08	14.44
+Brno	CZ	49.20	16.61
+Bratislava	SK	48.15	17.11
+Budapest	HU	47.50	19.04
+Ljubljana	SI	46.06	14.51
+Zagreb	HR	45.81	15.98
+Split	HR	43.51	16.44
+Dubrovnik	HR	42.65	18.09
+Sarajevo	BA	43.86	18.41
+Belgrade	RS	44.79	20.45
+Podgorica	ME	42.44	19.26
+Skopje	MK	42.00	21.43
+Tirana	AL	41.33	19.82
+Sofia	BG	42.70	23.32
+Varna	BG	43.21	27.91
+Bucharest	RO	44.43	26.10
+Cluj-Napoca	RO	46.77	23.59
+Chișinău	MD	47.01	28.86
+Kyiv	UA	50.45	30.52
+Lviv	UA	49.84	24.03
+Odesa	UA	46.48	30.72
+Kharkiv	UA	49.99	36.23
+Minsk	BY	53.90	27.57
+Moscow	RU	55.76	37.62
+Saint Petersburg	RU	59.94	30.31
+Kazan	RU	55.79	49.12
+Yekaterinburg	RU	56.84	60.61
+Novosibirsk	RU	55.01	82.93
+Irkutsk	RU	52.29	104.28
+Vladivostok	RU	43.12	131.89
+Sochi	RU	43.60	39.73
+Kaliningrad	RU	54.71	20.51
+Murmansk	RU	68.97	33.07
+Krasnoyarsk	RU	56.01	92.87
+Yakutsk	RU	62.03	129.73
+Petropavlovsk-Kamchatsky	RU	53.02	158.65
+Omsk	RU	54.99	73.37
+Samara	RU	53.20	50.15
+Cairo	EG	30.04	31.24
+Alexandria	EG	31.20	29.92
+Luxor	EG	25.69	32.64
+Aswan	EG	24.09	32.90
+Sharm El Sheikh	EG	27.92	34.33
+Hurghada	EG	27.26	33.81
+Tripoli	LY	32.89	13.19
+Tunis	TN	36.81	10.18
+Algiers	DZ	36.75	3.06
+Rabat	MA	34.02	-6.84
+Casablanca	MA	33.57	-7.59
+Marrakesh	MA	31.63	-8.01
+Fes	MA	34.03	-5.00
+Tangier	MA	35.76	-5.83
+Nouakchott	MR	18.08	-15.98
+Dakar	SN	14.72	-17.47
+Bamako	ML	12.64	-8.00
+Niamey	NE	13.51	2.13
+N'Djamena	TD	12.13	15.06
+Khartoum	SD	15.50	32.56
+Juba	SS	4.85	31.58
+Addis Ababa	ET	9.03	38.74
+Asmara	ER	15.32	38.93
+Djibouti	DJ	11.59	43.15
+Mogadishu	SO	2.05	45.32
+Nairobi	KE	-1.29	36.82
+Mombasa	KE	-4.04	39.67
+Kampala	UG	0.35	32.58
+Kigali	RW	-1.95	30.06
+Dar es Salaam	TZ	-6.79	39.21
+Zanzibar	TZ	-6.17	39.20
+Arusha	TZ	-3.37	36.68
+Lagos	NG	6.52	3.38
+Abuja	NG	9.08	7.40
+Accra	GH	5.60	-0.19
+Abidjan	CI	5.36	-4.01
+Monrovia	LR	6.30	-10.80
+Freetown	SL	8.47	-13.23
+Conakry	GN	9.64	-13.58
+Banjul	GM	13.45	-16.58
+Bissau	GW	11.86	-15.60
+Praia	CV	14.93	-23.51
+Ouagadougou	BF	12.37	-1.52
+Lomé	TG	6.13	1.22
+Cotonou	BJ	6.37	2.43
+Douala	CM	4.05	9.77
+Yaoundé	CM	3.85	11.50
+Bangui	CF	4.39	18.56
+Malabo	GQ	3.75	8.78
+Libreville	GA	0.42	9.47
+São Tomé	ST	0.34	6.73
+Kinshasa	CD	-4.44	15.27
+Brazzaville	CG	-4.27	15.28
+Luanda	AO	-8.84	13.23
+Lusaka	ZM	-15.39	28.32
+Livingstone	ZM	-17.85	25.86
+Harare	ZW	-17.83	31.05
+Victoria Falls	ZW	-17.93	25.84
+Lilongwe	MW	-13.96	33.79
+Maputo	MZ	-25.97	32.57
+Windhoek	NA	-22.56	17.08
+Gaborone	BW	-24.63	25.92
+Maun	BW	-19.98	23.42
+Johannesburg	ZA	-26.20	28.05
+Pretoria	ZA	-25.75	28.19
+Cape Town	ZA	-33.92	18.42
+Durban	ZA	-29.86	31.03
+Gqeberha	ZA	-33.96	25.60
+Maseru	LS	-29.31	27.48
+Mbabane	SZ	-26.31	31.14
+Antananarivo	MG	-18.88	47.51
+Port Louis	MU	-20.16	57.50
+Saint-Denis	RE	-20.88	55.45
+Victoria	SC	-4.62	55.45
+Moroni	KM	-11.70	43.26
+New York	US	40.71	-74.01
+Los Angeles	US	34.05	-118.24
+Chicago	US	41.88	-87.63
+Houston	US	29.76	-95.37
+Phoenix	US	33.45	-112.07
+Philadelphia	US	39.95	-75.17
+San Antonio	US	29.42	-98.49
+San Diego	US	32.72	-117.16
+Dallas	US	32.78	-96.80
+San Francisco	US	37.77	-122.42
+San Jose	US	37.34	-121.89
+Austin	US	30.27	-97.74
+Seattle	US	47.61	-122.33
+Portland	US	45.52	-122.68
+Denver	US	39.74	-104.99
+Las Vegas	US	36.17	-115.14
+Salt Lake City	US	40.76	-111.89
+Boston	US	42.36	-71.06
+Washington	US	38.91	-77.04
+Atlanta	US	33.75	-84.39
+Miami	US	25.76	-80.19
+Orlando	US	28.54	-81.38
+Tampa	US	27.95	-82.46
+New Orleans	US	29.95	-90.07
+Nashville	US	36.16	-86.78
+Memphis	US	35.15	-90.05
+St. Louis	US	38.63	-90.20
+Kansas City	US	39.10	-94.58
+Minneapolis	US	44.98	-93.27
+Detroit	US	42.33	-83.05
+Cleveland	US	41.50	-81.69
+Pittsburgh	US	40.44	-80.00
+Charlotte	US	35.23	-80.84
+Raleigh	US	35.78	-78.64
+Baltimore	US	39.29	-76.61
+Albuquerque	US	35.08	-106.65
+Tucson	US	32.22	-110.97
+El Paso	US	31.76	-106.49
+Oklahoma City	US	35.47	-97.52
+Omaha	US	41.26	-95.93
+Boise	US	43.62	-116.20
+Billings	US	45.78	-108.50
+Fargo	US	46.88	-96.79
+Sioux Falls	US	43.54	-96.73
+Cheyenne	US	41.14	-104.82
+Sacramento	US	38.58	-121.49
+Fresno	US	36.74	-119.79
+Reno	US	39.53	-119.81
+Spokane	US	47.66	-117.43
+Milwaukee	US	43.04	-87.91
+Indianapolis	US	39.77	-86.16
+Columbus	US	39.96	-83.00
+Cincinnati	US	39.10	-84.51
+Louisville	US	38.25	-85.76
+Jacksonville	US	30.33	-81.66
+Charleston	US	32.78	-79.93
+Buffalo	US	42.89	-78.88
+Burlington	US	44.48	-73.21
+Anchorage	US	61.22	-149.90
+Fairbanks	US	64.84	-147.72
+Juneau	US	58.30	-134.42
+Honolulu	US	21.31	-157.86
+Hilo	US	19.72	-155.09
+Kahului	US	20.89	-156.47
+Flagstaff	US	35.20	-111.65
+Jackson	US	43.48	-110.76
+Bozeman	US	45.68	-111.04
+Key West	US	24.56	-81.78
+San Juan	PR	18.47	-66.11
+Toronto	CA	43.65	-79.38
+Montreal	CA	45.50	-73.57
+Vancouver	CA	49.28	-123.12
+Calgary	CA	51.05	-114.07
+Edmonton	CA	53.55	-113.49
+Ottawa	CA	45.42	-75.70
+Winnipeg	CA	49.90	-97.14
+Quebec City	CA	46.81	-71.21
+Halifax	CA	44.65	-63.57
+Victoria	CA	48.43	-123.37
+St. John's	CA	47.56	-52.71
+Regina	CA	50.45	-104.62
+Saskatoon	CA	52.13	-106.67
+Whitehorse	CA	60.72	-135.06
+Yellowknife	CA	62.45	-114.37
+Iqaluit	CA	63.75	-68.52
+Banff	CA	51.18	-115.57
+Charlottetown	CA	46.24	-63.13
+Moncton	CA	46.09	-64.78
+Thunder Bay	CA	48.38	-89.25
+Kelowna	CA	49.89	-119.50
+Prince George	CA	53.92	-122.75
+Mexico City	MX	19.43	-99.13
+Guadalajara	MX	20.66	-103.35
+Monterrey	MX	25.69	-100.32
+Cancún	MX	21.16	-86.85
+Puebla	MX	19.04	-98.21
+Oaxaca	MX	17.07	-96.73
+Tijuana	MX	32.51	-117.04
+Mérida	MX	20.97	-89.62
+Puerto Vallarta	MX	20.65	-105.23
+Cabo San Lucas	MX	22.89	-109.92
+La Paz	MX	24.14	-110.31
+Chihuahua	MX	28.63	-106.07
+Hermosillo	MX	29.07	-110.96
+Guatemala City	GT	14.63	-90.51
+Belize City	BZ	17.50	-88.20
+San Salvador	SV	13.69	-89.22
+Tegucigalpa	HN	14.07	-87.19
+Managua	NI	12.11	-86.24
+San José	CR	9.93	-84.08
+Panama City	PA	8.98	-79.52
+Havana	CU	23.11	-82.37
+Santiago de Cuba	CU	20.02	-75.82
+Kingston	JM	18.02	-76.80
+Montego Bay	JM	18.47	-77.92
+Port-au-Prince	HT	18.59	-72.31
+Santo Domingo	DO	18.49	-69.93
+Punta Cana	DO	18.58	-68.40
+Nassau	BS	25.05	-77.36
+Bridgetown	BB	13.10	-59.62
+Port of Spain	TT	10.66	-61.51
+Oranjestad	AW	12.52	-70.03
+Willemstad	CW	12.11	-68.93
+Fort-de-France	MQ	14.62	-61.06
+Pointe-à-Pitre	GP	16.24	-61.53
+Castries	LC	14.01	-60.99
+St. George's	GD	12.05	-61.75
+Charlotte Amalie	VI	18.34	-64.93
+Hamilton	BM	32.29	-64.78
+Bogotá	CO	4.71	-74.07
+Medellín	CO	6.24	-75.58
+Cartagena	CO	10.39	-75.48
+Cali	CO	3.45	-76.53
+Caracas	VE	10.48	-66.90
+Maracaibo	VE	10.65	-71.64
+Quito	EC	-0.18	-78.47
+Guayaquil	EC	-2.17	-79.92
+Puerto Ayora	EC	-0.74	-90.31
+Lima	PE	-12.05	-77.04
+Cusco	PE	-13.53	-71.97
+Arequipa	PE	-16.41	-71.54
+Iquitos	PE	-3.75	-73.25
+La Paz	BO	-16.50	-68.15
+Santa Cruz de la Sierra	BO	-17.78	-63.18
+Uyuni	BO	-20.46	-66.83
+Santiago	CL	-33.45	-70.67
+Valparaíso	CL	-33.05	-71.62
+Antofagasta	CL	-23.65	-70.40
+Punta Arenas	CL	-53.16	-70.91
+Puerto Montt	CL	-41.47	-72.94
+San Pedro de Atacama	CL	-22.91	-68.20
+Hanga Roa	CL	-27.15	-109.43
+Buenos Aires	AR	-34.60	-58.38
+Córdoba	AR	-31.42	-64.18
+Mendoza	AR	-32.89	-68.84
+Rosario	AR	-32.95	-60.65
+Bariloche	AR	-41.13	-71.31
+Ushuaia	AR	-54.80	-68.30
+Salta	AR	-24.79	-65.41
+El Calafate	AR	-50.34	-72.27
+Puerto Iguazú	AR	-25.60	-54.57
+Montevideo	UY	-34.90	-56.16
+Punta del Este	UY	-34.96	-54.95
+Asunción	PY	-25.26	-57.58
+São Paulo	BR	-23.55	-46.63
+Rio de Janeiro	BR	-22.91	-43.17
+Brasília	BR	-15.79	-47.88
+Salvador	BR	-12.97	-38.50
+Fortaleza	BR	-3.73	-38.53
+Belo Horizonte	BR	-19.92	-43.94
+Manaus	BR	-3.12	-60.02
+Recife	BR	-8.05	-34.88
+Porto Alegre	BR	-30.03	-51.23
+Curitiba	BR	-25.43	-49.27
+Belém	BR	-1.46	-48.50
+Florianópolis	BR	-27.60	-48.55
+Foz do Iguaçu	BR	-25.55	-54.59
+Natal	BR	-5.79	-35.21
+Cuiabá	BR	-15.60	-56.10
+Georgetown	GY	6.80	-58.16
+Paramaribo	SR	5.85	-55.20
+Cayenne	GF	4.92	-52.31
+Stanley	FK	-51.69	-57.86
+Sydney	AU	-33.87	151.21
+Melbourne	AU	-37.81	144.96
+Brisbane	AU	-27.47	153.03
+Perth	AU	-31.95	115.86
+Adelaide	AU	-34.93	138.60
+Canberra	AU	-35.28	149.13
+Hobart	AU	-42.88	147.33
+Darwin	AU	-12.46	130.84
+Cairns	AU	-16.92	145.77
+Gold Coast	AU	-28.02	153.40
+Alice Springs	AU	-23.70	133.88
+Townsville	AU	-19.26	146.82
+Broome	AU	-17.96	122.24
+Newcastle	AU	-32.93	151.78
+Launceston	AU	-41.43	147.14
+Auckland	NZ	-36.85	174.76
+Wellington	NZ	-41.29	174.78
+Christchurch	NZ	-43.53	172.64
+Queenstown	NZ	-45.03	168.66
+Dunedin	NZ	-45.88	170.50
+Rotorua	NZ	-38.14	176.25
+Nelson	NZ	-41.27	173.28
+Suva	FJ	-18.14	178.44
+Nadi	FJ	-17.80	177.42
+Port Moresby	PG	-9.44	147.18
+Nouméa	NC	-22.28	166.46
+Papeete	PF	-17.53	-149.57
+Apia	WS	-13.83	-171.76
+Nuku'alofa	TO	-21.14	-175.20
+Port Vila	VU	-17.73	168.32
+Honiara	SB	-9.43	159.95
+Hagåtña	GU	13.48	144.75
+Tarawa	KI	1.33	172.98
+Majuro	MH	7.09	171.38
+Palikir	FM	6.92	158.16
+Koror	PW	7.34	134.48
+Avarua	CK	-21.21	-159.78
+Nuuk	GL	64.18	-51.72
+Longyearbyen	SJ	78.22	15.65
+Gibraltar	GI	36.14	-5.35
+Douglas	IM	54.15	-4.48
+Saint Helier	JE	49.19	-2.11
+Saint Peter Port	GG	49.46	-2.54
+Mariehamn	AX	60.10	19.94
+`
@@ -0,0 +1,172 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// pop3Client is a minimal POP3 client, with only the commands needed to download messages
+type pop3Client struct {
+	text *textproto.Conn
+}
+
+type pop3Message struct {
+	number int
+	uid    string
+}
+
+func dialPOP3(addr string) (*pop3Client, error) {
+	conn, err := tls.Dial("tcp", addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newPOP3Client(conn)
+}
+
+// newPOP3Client starts a POP3 session on an open connection to the server
+func newPOP3Client(conn net.Conn) (*pop3Client, error) {
+	c := &pop3Client{text: textproto.NewConn(conn)}
+
+	// greeting
+	if _, err := c.response(); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pop3Client) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(line[3:]), nil
+	}
+	return "", fmt.Errorf("POP3 error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+}
+
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+func (c *pop3Client) login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", password)
+	return err
+}
+
+// uidl lists all messages in the mailbox along with their unique ids
+func (c *pop3Client) uidl() ([]pop3Message, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]pop3Message, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid POP3 UIDL response: %s", line)
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid POP3 UIDL response: %s", line)
+		}
+		messages = append(messages, pop3Message{number: number, uid: fields[1]})
+	}
+	return messages, nil
+}
+
+func (c *pop3Client) retr(number int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", number); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+func (c *pop3Client) quit() error {
+	defer c.text.Close()
+	_, err := c.cmd("QUIT")
+	return err
+}
+
+// syncPOP3 imports the images from all messages on the POP3 server that haven't been seen before
+func (e *email) syncPOP3(found func(images []*image) error) error {
+	c, err := dialPOP3(fmt.Sprintf("%s:%s", e.server, e.port))
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+	return e.receivePOP3(c, found)
+}
+
+// receivePOP3 logs in to the POP3 server, and imports the images from messages it hasn't seen before
+func (e *email) receivePOP3(c *pop3Client, found func(images []*image) error) error {
+	if err := c.login(e.username, readSecret(&e.password)); err != nil {
+		return err
+	}
+
+	state, err := e.state()
+	if err != nil {
+		return err
+	}
+
+	messages, err := c.uidl()
+	if err != nil {
+		return err
+	}
+
+	// forget messages which have been deleted from the server
+	onServer := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		onServer[msg.uid] = true
+	}
+	for uid := range state.Seen {
+		if !onServer[uid] {
+			delete(state.Seen, uid)
+		}
+	}
+
+	var images []*image
+	for _, msg := range messages {
+		if state.Seen[msg.uid] {
+			continue
+		}
+		raw, err := c.retr(msg.number)
+		if err != nil {
+			return err
+		}
+		imgs, err := e.imagesFromMessage(fmt.Sprintf("%s.%s", e.server, msg.uid), bytes.NewReader(raw))
+		if err != nil {
+			return err
+		}
+		images = append(images, imgs...)
+		state.Seen[msg.uid] = true
+
+		if len(images) >= maxImagesPerPoll {
+			if err = e.flush(images, state, found); err != nil {
+				return err
+			}
+			images = nil
+		}
+	}
+
+	return e.flush(images, state, found)
+}
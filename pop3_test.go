@@ -0,0 +1,257 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePOP3 is a POP3 server holding messages by unique id, which records the messages retrieved
+type fakePOP3 struct {
+	sync.Mutex
+	uids      []string
+	messages  map[string]string
+	retrieved []string
+	addr      string
+}
+
+func newFakePOP3(t *testing.T) *fakePOP3 {
+	f := &fakePOP3{messages: make(map[string]string)}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakePOP3) add(uid, raw string) {
+	f.Lock()
+	defer f.Unlock()
+	f.uids = append(f.uids, uid)
+	f.messages[uid] = raw
+}
+
+func (f *fakePOP3) remove(uid string) {
+	f.Lock()
+	defer f.Unlock()
+	for i := range f.uids {
+		if f.uids[i] == uid {
+			f.uids = append(f.uids[:i], f.uids[i+1:]...)
+			break
+		}
+	}
+	delete(f.messages, uid)
+}
+
+func (f *fakePOP3) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "+OK ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		f.Lock()
+		switch strings.ToUpper(fields[0]) {
+		case "USER":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "PASS":
+			if len(fields) == 2 && fields[1] == "secret" {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-ERR invalid password\r\n")
+			}
+		case "UIDL":
+			fmt.Fprint(conn, "+OK\r\n")
+			for i, uid := range f.uids {
+				fmt.Fprintf(conn, "%d %s\r\n", i+1, uid)
+			}
+			fmt.Fprint(conn, ".\r\n")
+		case "RETR":
+			number, _ := strconv.Atoi(fields[1])
+			if number < 1 || number > len(f.uids) {
+				fmt.Fprint(conn, "-ERR no such message\r\n")
+				break
+			}
+			uid := f.uids[number-1]
+			f.retrieved = append(f.retrieved, uid)
+			fmt.Fprint(conn, "+OK\r\n")
+			for _, l := range strings.Split(strings.TrimSuffix(f.messages[uid], "\r\n"), "\r\n") {
+				// lines starting with a dot are stuffed with another one
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				fmt.Fprintf(conn, "%s\r\n", l)
+			}
+			fmt.Fprint(conn, ".\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "+OK\r\n")
+			f.Unlock()
+			return
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+		f.Unlock()
+	}
+}
+
+// takeRetrieved returns the messages retrieved since it was last called
+func (f *fakePOP3) takeRetrieved() []string {
+	f.Lock()
+	defer f.Unlock()
+	retrieved := f.retrieved
+	f.retrieved = nil
+	sort.Strings(retrieved)
+	return retrieved
+}
+
+func (f *fakePOP3) dial(t *testing.T) *pop3Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newPOP3Client(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testPOP3Message(name string) string {
+	return strings.Join([]string{
+		"From: family@example.com",
+		"To: frame@example.com",
+		"Subject: " + name,
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=boundary",
+		"",
+		"--boundary",
+		"Content-Type: text/plain",
+		"",
+		".a line starting with a dot",
+		"..and one starting with two",
+		".",
+		"--boundary",
+		"Content-Type: image/jpeg",
+		"Content-Disposition: attachment; filename=" + name + ".jpg",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"/9j/4AAQSkZJRgABAQAAAQABAAD/2wBDAAEBAQ==",
+		"--boundary--",
+		"",
+	}, "\r\n")
+}
+
+func TestPOP3DotStuffing(t *testing.T) {
+	server := newFakePOP3(t)
+	message := testPOP3Message("stuffed")
+	server.add("stuffed", message)
+
+	c := server.dial(t)
+	defer c.quit()
+	if err := c.login("frame", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := c.retr(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dot reader also turns the CRLF line endings into LF
+	if expected := strings.Replace(message, "\r\n", "\n", -1); string(raw) != expected {
+		t.Fatalf("Expected the message as it was sent, got:\n%s", raw)
+	}
+}
+
+func TestPOP3Login(t *testing.T) {
+	server := newFakePOP3(t)
+	c := server.dial(t)
+	defer c.quit()
+	if err := c.login("frame", "wrong"); err == nil || !strings.Contains(err.Error(), "invalid password") {
+		t.Fatalf("Expected the server's error for a wrong password, got %v", err)
+	}
+}
+
+func TestPOP3SeenMessages(t *testing.T) {
+	openTestStore(t)
+	server := newFakePOP3(t)
+	server.add("one", testPOP3Message("one"))
+	server.add("two", testPOP3Message("two"))
+
+	host, port, _ := net.SplitHostPort(server.addr)
+	e := &email{protocol: emailPOP3, server: host, port: port, username: "frame", password: "secret"}
+	poll := func() []string {
+		t.Helper()
+		var keys []string
+		c := server.dial(t)
+		defer c.quit()
+		err := e.receivePOP3(c, func(images []*image) error {
+			for _, img := range images {
+				keys = append(keys, img.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	expected := []string{host + ".one.one.jpg", host + ".two.two.jpg"}
+	if keys := poll(); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+	if retrieved := server.takeRetrieved(); len(retrieved) != 2 {
+		t.Fatalf("Expected both messages to be retrieved, got %v", retrieved)
+	}
+
+	if keys := poll(); len(keys) != 0 {
+		t.Fatalf("Expected nothing new, got %v", keys)
+	}
+	if retrieved := server.takeRetrieved(); len(retrieved) != 0 {
+		t.Fatalf("Expected messages already seen not to be retrieved again, got %v", retrieved)
+	}
+
+	server.remove("one")
+	server.add("three", testPOP3Message("three"))
+	if keys := poll(); len(keys) != 1 || keys[0] != host+".three.three.jpg" {
+		t.Fatalf("Expected only the new message, got %v", keys)
+	}
+	if retrieved := server.takeRetrieved(); len(retrieved) != 1 || retrieved[0] != "three" {
+		t.Fatalf("Expected only the new message to be retrieved, got %v", retrieved)
+	}
+
+	state, err := e.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Seen["one"] || !state.Seen["two"] || !state.Seen["three"] {
+		t.Fatalf("Expected messages deleted from the server to be forgotten, seen %v", state.Seen)
+	}
+}
@@ -4,30 +4,63 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/spf13/viper"
 )
 
 const maxImagesPerPoll = 50
+const maxVideoSize = 50 * 1024 * 1024 // only short clips are shown, anything larger is skipped
 const userAgent = "Mozilla/5.0 (Windows NT 6.1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/41.0.2228.0 Safari/537.36"
 
-type providerConfig map[string]interface{}
-
 // Provider is an interface for an image provider
 type provider interface {
 	name() string
-	initialize(config providerConfig) error
+	initialize(config *configSection) error
 	getImages(lastImage *image) ([]*image, error)
 }
 
+// watcher is implemented by providers that can push new images as soon as they are available
+// instead of waiting to be polled
+type watcher interface {
+	watching() bool
+	watch(found func(images []*image) error)
+}
+
+// secretReloader is implemented by providers with secrets, which are passed their config section again
+// when the config is reloaded, so that a changed password or token is used without restarting
+type secretReloader interface {
+	reloadSecrets(config *configSection) error
+}
+
 var providers []provider
 
-func initializeProviders(pollDuration string, config providerConfig) {
-	poll, err := time.ParseDuration(pollDuration)
-	if err != nil {
-		poll = 1 * time.Hour
+// configuredProviders are the loaded providers by the key they're configured under
+var configuredProviders = make(map[string]provider)
+
+// startProviders starts watching and polling the loaded providers
+func startProviders(poll time.Duration) {
+	for _, p := range providers {
+		if w, ok := p.(watcher); ok && w.watching() {
+			name := p.name()
+			go w.watch(func(images []*image) error {
+				imagesFetched.WithLabelValues(name).Add(float64(len(images)))
+				return addImages(images)
+			})
+		}
 	}
 
+	go pollProviders(poll)
+}
+
+// loadProviders sets up the configured providers, returning any configuration errors
+func loadProviders(config map[string]interface{}) []error {
+	var errs []error
 	for k, v := range config {
 		var p provider
 		switch k {
@@ -37,39 +70,74 @@ func initializeProviders(pollDuration string, config providerConfig) {
 			p = &google{}
 		case "email":
 			p = &email{}
+		case "upload":
+			p = &upload{}
 		default:
-			log.Printf("Invalid provider name: %s", k)
+			errs = append(errs, &configError{path: "providers." + k, msg: "unknown provider, must be " +
+				"instagram, google-photos, email or upload"})
 			continue
 		}
-		if v != nil {
-			err = p.initialize(v.(map[string]interface{}))
-			if err != nil {
-				log.Printf("Error initializing provider %s: %s", p.name(), err)
-			}
+
+		values, ok := configMap(v)
+		if !ok && v != nil {
+			errs = append(errs, &configError{path: "providers." + k, msg: "expected a group of settings"})
+			continue
 		}
+		section := newConfigSection("providers."+k, values)
+		errs = appendErrors(errs, p.initialize(section))
+		limit, err := storageLimitConfig(section)
+		errs = appendErrors(errs, err)
+		errs = appendErrors(errs, section.unknownKeys())
+		providerLimits[p.name()] = limit
 
 		providers = append(providers, p)
+		configuredProviders[k] = p
 	}
+	return errs
+}
 
-	go pollProviders(poll)
+// reloadOnHangup reloads the providers' secrets whenever the process is sent SIGHUP, i.e. by systemctl
+// reload once a secret file has been rotated
+func reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		errs := reloadSecrets()
+		for _, err := range errs {
+			log.Printf("Error reloading secrets: %s\n", err)
+		}
+		if len(errs) == 0 {
+			log.Println("Secrets reloaded")
+		}
+	}
 }
 
-func pollProviders(poll time.Duration) {
-	for _, p := range providers {
-		last, err := getLastImage(p.name())
-		if err != nil {
-			log.Printf("Error getting last image from %s: %s\n", p.name(), err)
+// reloadSecrets reads the config file again and resolves the secrets of the loaded providers, any other
+// changes to the config need a restart
+func reloadSecrets() []error {
+	if err := viper.ReadInConfig(); err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for k, v := range viper.GetStringMap("providers") {
+		r, ok := configuredProviders[k].(secretReloader)
+		if !ok {
 			continue
 		}
-		images, err := p.getImages(last)
-		if err != nil {
-			log.Printf("Error getting images from %s: %s\n", p.name(), err)
+		values, _ := configMap(v)
+		errs = appendErrors(errs, r.reloadSecrets(newConfigSection("providers."+k, values)))
+	}
+	return errs
+}
+
+func pollProviders(poll time.Duration) {
+	for _, p := range providers {
+		if w, ok := p.(watcher); ok && w.watching() {
 			continue
 		}
-
-		err = addImages(images)
+		err := pollProvider(p)
 		if err != nil {
-			log.Printf("Error inserting images from %s: %s\n", p.name(), err)
+			log.Println(err)
 		}
 	}
 
@@ -77,30 +145,45 @@ func pollProviders(poll time.Duration) {
 	pollProviders(poll)
 }
 
-func (c providerConfig) getString(field string) (string, bool) {
-	if val, ok := c[field]; ok {
-		val, ok := val.(string)
-		return val, ok
+// pollProvider fetches and stores a provider's new images
+func pollProvider(p provider) error {
+	last, err := getLastImage(p.name())
+	if err != nil {
+		return fmt.Errorf("Error getting last image from %s: %s", p.name(), err)
+	}
+	start := time.Now()
+	images, err := p.getImages(last)
+	pollDuration.WithLabelValues(p.name()).Observe(time.Since(start).Seconds())
+	recordProviderResult(p.name(), err)
+	if err != nil {
+		return fmt.Errorf("Error getting images from %s: %s", p.name(), err)
+	}
+	imagesFetched.WithLabelValues(p.name()).Add(float64(len(images)))
+
+	err = addImages(images)
+	if err != nil {
+		return fmt.Errorf("Error inserting images from %s: %s", p.name(), err)
 	}
-	return "", false
+	return nil
 }
 
-func (c providerConfig) getStringSlice(field string) ([]string, bool) {
-	if val, ok := c[field]; ok {
-		val, ok := val.([]interface{})
-		if !ok {
-			return nil, false
-		}
-		s := make([]string, len(val))
-		for i := range s {
-			str, ok := val[i].(string)
-			if !ok {
-				return nil, false
-			}
-			s[i] = str
-		}
+// storageLimitSettings are a provider's share of the storage budget, which can be set for any provider
+type storageLimitSettings struct {
+	Quota    string  `config:"quota"`
+	MinShare float64 `config:"minShare"`
+}
 
-		return s, ok
+func storageLimitConfig(config *configSection) (storageLimit, error) {
+	settings := storageLimitSettings{}
+	if err := config.decode(&settings); err != nil {
+		return storageLimit{}, err
+	}
+	quota, err := parseSize(settings.Quota)
+	if err != nil {
+		return storageLimit{}, config.errorf("quota", "%s", err)
+	}
+	if settings.MinShare < 0 || settings.MinShare > 1 {
+		return storageLimit{}, config.errorf("minShare", "must be between 0 and 1")
 	}
-	return nil, false
+	return storageLimit{quota: quota, minShare: settings.MinShare}, nil
 }
@@ -5,10 +5,13 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math"
 	"math/rand"
 	"sync"
+	"time"
 
+	"github.com/spf13/viper"
 	bh "github.com/timshannon/bolthold"
 )
 
@@ -17,19 +20,33 @@ const (
 	queueOrderRandom  = "random"
 	queueOrderNewest  = "newest"
 	queueOrderOldest  = "oldest"
+	queueOrderStory   = "story"
 )
 
 type queue struct {
 	sync.Mutex
-	queue []string
+	queue []queueEntry
 	order collator
 }
 
+// queueEntry is an image waiting to be shown, with what's needed to pair it without loading it
+type queueEntry struct {
+	key         string
+	date        time.Time
+	orientation string
+}
+
 type collator interface {
 	query() *bh.Query
 	next(total int) int
 }
 
+// weightedCollator is a collator where favorite and highly rated images show up more often by
+// appearing in the queue more than once
+type weightedCollator interface {
+	weighted() bool
+}
+
 func newQueue(size int, order string) *queue {
 	var col collator
 
@@ -40,11 +57,13 @@ func newQueue(size int, order string) *queue {
 		col = &sequentialCollator{descending: true}
 	case queueOrderOldest:
 		col = &sequentialCollator{}
+	case queueOrderStory:
+		col = &storyCollator{}
 	default:
 		col = &defaultCollator{}
 	}
 	return &queue{
-		queue: make([]string, 0, size),
+		queue: make([]queueEntry, 0, size),
 		order: col,
 	}
 }
@@ -59,14 +78,35 @@ func (q *queue) repopulate() error {
 		return fmt.Errorf("no images found")
 	}
 
+	queueRepopulations.Inc()
 	q.queue = q.queue[:0]
 	for i := range images {
-		q.queue = append(q.queue, images[i].Key)
+		copies := 1
+		if w, ok := q.order.(weightedCollator); ok && w.weighted() {
+			copies = imageWeight(images[i])
+		}
+		entry := queueEntry{key: images[i].Key, date: images[i].Date, orientation: images[i].orientation()}
+		for c := 0; c < copies; c++ {
+			q.queue = append(q.queue, entry)
+		}
 	}
 
 	return nil
 }
 
+// imageWeight is how many times an image is added to a weighted queue
+func imageWeight(img *image) int {
+	weight := 1.0
+	if img.Favorite {
+		weight *= viper.GetFloat64("favoriteWeight")
+	}
+	weight += float64(img.Rating) * viper.GetFloat64("ratingWeight")
+	if weight < 1 {
+		return 1
+	}
+	return int(math.Round(weight))
+}
+
 func (q *queue) next() (*image, error) {
 	q.Lock()
 	defer q.Unlock()
@@ -96,15 +136,93 @@ func (q *queue) next() (*image, error) {
 		return nil, nil
 	}
 
-	img, err := getImage(q.queue[i])
+	return q.take(i)
+}
+
+// take removes the image at i from the queue and returns it.  The queue must be locked
+func (q *queue) take(i int) (*image, error) {
+	img, err := getImage(q.queue[i].key)
 	if err != nil {
 		return nil, err
 	}
 
 	q.queue = append(q.queue[:i], q.queue[i+1:]...)
+
+	err = markShown(img.Key)
+	if err != nil {
+		log.Printf("Error marking image %s as shown: %s\n", img.Key, err)
+	}
 	return img, nil
 }
 
+// nextSlide returns the next images to show together on a display with the passed in orientation.
+// Images which don't fit the display's orientation, like portrait images on a landscape display, are
+// paired with another image of the same orientation, taken closest to it
+func (q *queue) nextSlide(display string) ([]*image, error) {
+	img, err := q.next()
+	if err != nil || img == nil {
+		return nil, err
+	}
+	slide := []*image{img}
+	if !viper.GetBool("pairImages") || display == orientationUnknown || img.orientation() == display ||
+		img.orientation() == orientationUnknown {
+		return slide, nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	partner := -1
+	var closest time.Duration
+	for i := range q.queue {
+		if q.queue[i].key == img.Key || q.queue[i].orientation != img.orientation() {
+			continue
+		}
+		diff := q.queue[i].date.Sub(img.Date)
+		if diff < 0 {
+			diff = -diff
+		}
+		if partner == -1 || diff < closest {
+			partner, closest = i, diff
+		}
+	}
+	if partner == -1 {
+		return slide, nil
+	}
+
+	other, err := q.take(partner)
+	if err != nil {
+		log.Printf("Error getting image to pair with %s: %s\n", img.Key, err)
+		return slide, nil
+	}
+	// shown in the order they were taken
+	if other.Date.Before(img.Date) {
+		return []*image{other, img}, nil
+	}
+	return append(slide, other), nil
+}
+
+// queuedImages returns the images which are shown, limited to those with the people and from the
+// countries in the people and countries settings when they're set
+func queuedImages() *bh.Query {
+	query := visibleImages()
+	if people := viper.GetStringSlice("people"); len(people) > 0 {
+		names := make([]interface{}, len(people))
+		for i := range people {
+			names[i] = people[i]
+		}
+		query = query.And("People").ContainsAny(names...)
+	}
+	if countries := viper.GetStringSlice("countries"); len(countries) > 0 {
+		codes := make([]interface{}, len(countries))
+		for i := range countries {
+			codes[i] = countryCode(countries[i])
+		}
+		query = query.And("Country").In(codes...)
+	}
+	return query
+}
+
 // collators
 
 // defaultCollator returns images randomly weighted towards newer images
@@ -114,11 +232,12 @@ type defaultCollator struct {
 
 func (d *defaultCollator) query() *bh.Query {
 	d.queueSize = 0
-	all := bh.Query{}
 
-	return all.SortBy("Date").Reverse()
+	return queuedImages().SortBy("Date").Reverse()
 }
 
+func (d *defaultCollator) weighted() bool { return true }
+
 func (d *defaultCollator) next(total int) int {
 	d.queueSize++
 	if d.queueSize > 50 {
@@ -136,9 +255,11 @@ type randomCollator struct{}
 
 func (r *randomCollator) query() *bh.Query {
 	// return all in any order
-	return nil
+	return queuedImages()
 }
 
+func (r *randomCollator) weighted() bool { return true }
+
 func (r *randomCollator) next(total int) int {
 	return rand.Intn(total)
 }
@@ -148,13 +269,31 @@ type sequentialCollator struct {
 }
 
 func (s *sequentialCollator) query() *bh.Query {
-	all := bh.Query{}
 	if s.descending {
-		return all.SortBy("Date").Reverse()
+		return queuedImages().SortBy("Date").Reverse()
 	}
-	return all.SortBy("Date")
+	return queuedImages().SortBy("Date")
 }
 
 func (s *sequentialCollator) next(total int) int {
 	return 0
 }
+
+// storyCollator plays every image of an event in the order they were taken, then moves on to another
+// randomly chosen event
+type storyCollator struct {
+	event string
+}
+
+func (s *storyCollator) query() *bh.Query {
+	s.event = randomEvent(s.event)
+	if s.event == "" {
+		// images haven't been grouped yet
+		return queuedImages().SortBy("Date")
+	}
+	return queuedImages().And("Event").Eq(s.event).SortBy("Date")
+}
+
+func (s *storyCollator) next(total int) int {
+	return 0
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/zalando/go-keyring"
+)
+
+// secret is a config setting which can reference where its value is kept instead of holding it:
+//
+//	env:NAME              an environment variable
+//	file:/path            the contents of a file, i.e. a docker or systemd secret
+//	keyring:service/user  the system keyring
+//
+// Anything else is the value itself
+type secret string
+
+const (
+	secretEnv     = "env:"
+	secretFile    = "file:"
+	secretKeyring = "keyring:"
+)
+
+const secretKeyFile = "secret.key"
+
+// resolveSecret returns the value of a secret reference
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, secretEnv):
+		name := strings.TrimPrefix(ref, secretEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, secretFile):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, secretFile))
+		if err != nil {
+			return "", err
+		}
+		// secret files are usually written with a trailing newline
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(ref, secretKeyring):
+		entry := strings.TrimPrefix(ref, secretKeyring)
+		i := strings.Index(entry, "/")
+		if i == -1 {
+			return "", fmt.Errorf("keyring secrets must be keyring:service/user")
+		}
+		return keyring.Get(entry[:i], entry[i+1:])
+	}
+	return ref, nil
+}
+
+// secretsLock guards the secrets kept by providers, which are replaced when the config is reloaded
+var secretsLock sync.RWMutex
+
+// readSecret returns a secret kept by a provider
+func readSecret(value *string) string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	return *value
+}
+
+// sealed is a secret encrypted with the store's key, so tokens kept in the data file can't be read from
+// a copy of it
+type sealed []byte
+
+var storeKey = struct {
+	sync.Mutex
+	aead cipher.AEAD
+}{}
+
+// storeCipher returns the cipher for sealed secrets.  The key is the secretKey setting, or a random
+// key generated next to the data file if it isn't set
+func storeCipher() (cipher.AEAD, error) {
+	storeKey.Lock()
+	defer storeKey.Unlock()
+	if storeKey.aead != nil {
+		return storeKey.aead, nil
+	}
+
+	var key [32]byte
+	if ref := viper.GetString("secretKey"); ref != "" {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading secretKey: %s", err)
+		}
+		key = sha256.Sum256([]byte(value))
+	} else {
+		file := filepath.Join(filepath.Dir(viper.GetString("dataFile")), secretKeyFile)
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			log.Printf("Generating secret key %s\n", file)
+			data = make([]byte, len(key))
+			if _, err = rand.Read(data); err != nil {
+				return nil, err
+			}
+			err = ioutil.WriteFile(file, data, 0600)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != len(key) {
+			return nil, fmt.Errorf("Invalid secret key %s", file)
+		}
+		copy(key[:], data)
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	storeKey.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return storeKey.aead, nil
+}
+
+// seal encrypts a secret to keep in the store
+func seal(value string) (sealed, error) {
+	aead, err := storeCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(value), nil), nil
+}
+
+// open decrypts a sealed secret
+func (s sealed) open() (string, error) {
+	aead, err := storeCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(s) < aead.NonceSize() {
+		return "", fmt.Errorf("Invalid sealed secret")
+	}
+	value, err := aead.Open(nil, s[:aead.NonceSize()], s[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("Error opening sealed secret, has the secret key changed? %s", err)
+	}
+	return string(value), nil
+}
@@ -5,58 +5,529 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"html/template"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
 	bh "github.com/timshannon/bolthold"
+	"golang.org/x/oauth2"
 )
 
+// imageInfo is an image's metadata without its data
+type imageInfo struct {
+	Key         string    `json:"key"`
+	Date        time.Time `json:"date"`
+	Provider    string    `json:"provider"`
+	ContentType string    `json:"contentType"`
+	Caption     string    `json:"caption,omitempty"`
+	Sender      string    `json:"sender,omitempty"`
+}
+
+func newImageInfo(img *image) imageInfo {
+	return imageInfo{
+		Key:         img.Key,
+		Date:        img.Date,
+		Provider:    img.Provider,
+		ContentType: img.ContentType,
+		Caption:     img.Caption,
+		Sender:      img.Sender,
+	}
+}
+
+// layoutCookie is set by the display's page to the orientation of its screen
+const layoutCookie = "layout"
+
+// displayLayout returns the orientation of the display making the request, if it's known
+func displayLayout(r *http.Request) string {
+	cookie, err := r.Cookie(layoutCookie)
+	if err != nil {
+		return orientationUnknown
+	}
+	switch cookie.Value {
+	case orientationLandscape, orientationPortrait:
+		return cookie.Value
+	}
+	return orientationUnknown
+}
+
+// slideImage is one of the images shown together on a page
+type slideImage struct {
+	Key      string
+	URL      string
+	Fit      string
+	Caption  string
+	Place    string
+	Favorite bool
+	Rating   int
+	FocusX   float64 // where the image zooms in on, in percent
+	FocusY   float64
+}
+
+// newSlideImage returns an image shown with a fit mode on a width by height part of the display, the
+// size is 0 if it isn't known
+func newSlideImage(img *image, fit string, width, height int) slideImage {
+	switch {
+	case img.isVideo():
+		// videos are cropped by the browser, and can't be shown over a blurred copy
+		if fit != fitCover {
+			fit = fitContain
+		}
+	case !img.hasVariants() || width == 0:
+		fit = fitContain
+	}
+	s := slideImage{
+		Key:      img.Key,
+		URL:      imageURL(img, fit, width, height),
+		Fit:      fit,
+		Caption:  img.Caption,
+		Favorite: img.Favorite,
+		Rating:   img.Rating,
+		FocusX:   50,
+		FocusY:   50,
+	}
+	if viper.GetBool("showPlace") {
+		s.Place = img.Place
+	}
+	if img.Focus != nil {
+		s.FocusX = img.Focus.X * 100
+		s.FocusY = img.Focus.Y * 100
+	}
+	return s
+}
+
 func startServer(port string, imageDuration time.Duration, q *queue) error {
 	var mainTemplate = template.Must(template.New("").Parse(html))
 	var loadingTemplate = template.Must(template.New("").Parse(loading))
 
-	templateData := struct {
+	type templateData struct {
 		Duration int64
-	}{
-		Duration: int64(imageDuration / time.Millisecond),
+		Slide    []slideImage
+		Images   []string
+		Layout   string
+		Video    bool
+		Session  string
+		Paused   bool
+		Upload   bool
+		Title    *titleCard
+		transitionData
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	duration := int64(imageDuration / time.Millisecond)
+
+	auth, err := newAuthenticator()
+	if err != nil {
+		return err
+	}
+
+	uploads := uploadProvider()
+	if uploads != nil && uploads.qrToken != "" && auth.enabled() {
+		// guests scanning the QR code upload with its token, whether or not it's also in auth.tokens
+		auth.tokens = append(auth.tokens, authToken{name: "upload QR code", token: uploads.qrToken,
+			role: roleUploader})
+	}
+
+	http.HandleFunc("/", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" || r.URL.Path != "/" {
 			http.NotFound(w, r)
 			return
 		}
 
-		count, err := store.Count(&image{}, &bh.Query{})
+		count, err := store.Count(&image{}, visibleImages())
 		if err != nil {
 			log.Printf("Error getting image count: %s", err)
 		}
 		if count == 0 {
-			loadingTemplate.Execute(w, templateData)
+			loadingTemplate.Execute(w, templateData{Duration: duration, Upload: uploads != nil})
+			return
+		}
+
+		s, err := getSession(w, r)
+		if err != nil {
+			log.Printf("Error starting session: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		layout := displayLayout(r)
+		var slide []*image
+		if r.URL.Query().Get("go") == commandPrevious {
+			slide, err = s.previous(q, layout)
+		} else {
+			slide, err = s.next(q, layout)
+		}
+		if err != nil || len(slide) == 0 {
+			log.Printf("Error getting image: %s\n", err)
+			loadingTemplate.Execute(w, templateData{Duration: duration, Upload: uploads != nil})
 			return
 		}
-		mainTemplate.Execute(w, templateData)
-	})
+		imagesServed.WithLabelValues(sessionLabel(s.id)).Add(float64(len(slide)))
+
+		data := templateData{
+			Duration: duration,
+			Layout:   layout,
+			Video:    len(slide) == 1 && slide[0].isVideo(),
+			Session:  s.id,
+			Paused:   s.isPaused(),
+		}
+		if s.startsEvent(slide[0].Event) && viper.GetString("imageOrder") == queueOrderStory &&
+			viper.GetBool("storyTitles") {
+			data.Title, err = eventTitle(slide[0].Event)
+			if err != nil {
+				log.Printf("Error getting the title of event %s: %s\n", slide[0].Event, err)
+			}
+		}
+		// paired images each get an equal part of the display
+		fit := frameFit(w, r)
+		width, height, _ := displaySize(r)
+		if layout == orientationPortrait {
+			height /= len(slide)
+		} else {
+			width /= len(slide)
+		}
+		for _, img := range slide {
+			fitted := newSlideImage(img, fit, width, height)
+			data.Slide = append(data.Slide, fitted)
+			data.Images = append(data.Images, fitted.URL)
+		}
+		data.transitionData = newTransitionData(frameTransition(w, r), data.Video, imageDuration)
+		mainTemplate.Execute(w, data)
+	}))
 
-	http.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+	// commands from remote controls are pushed to each display
+	http.HandleFunc("/events", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		s := controlledSessions(r.URL.Query().Get("session"))
+		if len(s) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		s[0].listen(w, r)
+	}))
+
+	http.HandleFunc("/control", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		controlled := controlledSessions("")
+		statuses := make([]sessionStatus, len(controlled))
+		for i := range controlled {
+			statuses[i] = controlled[i].status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	}))
+
+	// remote control of all active displays, or a single one with the session parameter
+	for _, command := range []string{commandNext, commandPrevious, commandPause, commandResume} {
+		command := command
+		http.HandleFunc("/control/"+command, auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.NotFound(w, r)
+				return
+			}
+			controlled := controlledSessions(r.FormValue("session"))
+			if len(controlled) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			for _, s := range controlled {
+				s.send(command)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	http.HandleFunc("/image", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.NotFound(w, r)
 			return
 		}
-		img, err := q.next()
+
+		var img *image
+		var err error
+		if key := r.URL.Query().Get("key"); key != "" {
+			img, err = getImage(key)
+		} else {
+			img, err = q.next()
+		}
 		if err != nil || img == nil {
 			log.Printf("Error getting image: %s\n", err)
 			http.NotFound(w, r)
 			return
 		}
 
-		w.Header().Set("Content-Type", img.ContentType)
+		if img.Held && requestIdentity(r).role < roleAdmin {
+			// held images are only visible to the admins moderating them
+			http.NotFound(w, r)
+			return
+		}
+		if img.Hidden {
+			// only a record of hidden images is kept
+			http.NotFound(w, r)
+			return
+		}
+
+		data, ctype := img.Data, img.ContentType
+		fit := r.URL.Query().Get("fit")
+		if width, height, ok := parseDisplaySize(r.URL.Query().Get("size")); ok && fit != fitContain &&
+			validFit(fit) && img.hasVariants() {
+			variant, err := imageVariant(img, fit, width, height)
+			if err != nil {
+				log.Printf("Error rendering %s variant of %s: %s\n", fit, img.Key, err)
+			} else {
+				data, ctype = variant, "image/jpeg"
+			}
+		}
+
+		w.Header().Set("Content-Type", ctype)
+		if r.URL.Query().Get("key") != "" {
+			// cached so the next page can transition from this image without loading it again
+			w.Header().Set("Cache-Control", "private, max-age=86400")
+		}
+
+		http.ServeContent(w, r, img.Key, time.Time{}, bytes.NewReader(data))
+	}))
+
+	// moderation of held images, images can be viewed by admins with /image?key=
+	http.HandleFunc("/held", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		images, err := getHeldImages()
+		if err != nil {
+			log.Printf("Error getting held images: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos := make([]imageInfo, len(images))
+		for i := range images {
+			infos[i] = newImageInfo(images[i])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}))
+
+	http.HandleFunc("/held/approve", auth.require(roleAdmin, imageUpdate(func(r *http.Request, img *image) {
+		img.Held = false
+	})))
+
+	http.HandleFunc("/held/reject", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		err := deleteImage(r.FormValue("key"))
+		if err == bh.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error rejecting image: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	http.HandleFunc("/image/pin", auth.require(roleAdmin, imageUpdate(func(r *http.Request, img *image) {
+		img.Pinned = r.FormValue("pinned") != "false"
+	})))
+
+	http.HandleFunc("/image/favorite", auth.require(roleViewer, imageUpdate(func(r *http.Request, img *image) {
+		img.Favorite = r.FormValue("favorite") != "false"
+	})))
+
+	// anyone watching a frame can hide a bad photo from it.  Hidden images can't be shown again, since
+	// their data is removed, so the slideshow asks before hiding one
+	http.HandleFunc("/image/hide", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.FormValue("hidden") == "false" {
+			http.Error(w, "hidden images can't be shown again, their data has been removed", http.StatusBadRequest)
+			return
+		}
+		err := hideImage(r.FormValue("key"))
+		if err == bh.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error hiding image: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	http.HandleFunc("/image/rate", auth.require(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		rating, err := strconv.Atoi(r.FormValue("rating"))
+		if err != nil || rating < 0 || rating > 5 {
+			http.Error(w, "rating must be between 0 and 5", http.StatusBadRequest)
+			return
+		}
+		imageUpdate(func(r *http.Request, img *image) {
+			img.Rating = rating
+		})(w, r)
+	}))
+
+	// faces are named on the people page, so the people setting can choose whose images are shown
+	http.HandleFunc("/people", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		peopleTemplate.Execute(w, nil)
+	}))
+
+	http.HandleFunc("/faces", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		faces, err := getFaces()
+		if err != nil {
+			log.Printf("Error getting faces: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(faces)
+	}))
+
+	http.HandleFunc("/face", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		img, err := getImage(r.FormValue("key"))
+		if err == bh.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error getting image: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		index, _ := strconv.Atoi(r.FormValue("index"))
+		data, err := faceThumbnail(img, index, faceThumbnailSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Write(data)
+	}))
+
+	http.HandleFunc("/face/name", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		index, err := strconv.Atoi(r.FormValue("index"))
+		if err != nil {
+			http.Error(w, "index must be a number", http.StatusBadRequest)
+			return
+		}
+		img, err := getImage(r.FormValue("key"))
+		if err == nil && (index < 0 || index >= len(img.Faces)) {
+			http.Error(w, "index must be one of the image's faces", http.StatusBadRequest)
+			return
+		}
+		imageUpdate(func(r *http.Request, img *image) {
+			img.nameFace(index, r.FormValue("person"))
+		})(w, r)
+	}))
+
+	// starts signing in to a provider's account, the person authorizing it is sent to the returned page
+	// with the code, and the provider is authorized in the background once they have signed in
+	http.HandleFunc("/authorize", auth.require(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		name := r.FormValue("provider")
+		a, err := providerAuthorizer(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		prompt := make(chan *oauth2.DeviceAuthResponse, 1)
+		failed := make(chan error, 1)
+		go func() {
+			err := a.authorize(context.Background(), func(auth *oauth2.DeviceAuthResponse) {
+				prompt <- auth
+			})
+			if err != nil {
+				log.Printf("Error authorizing provider %s: %s\n", name, err)
+				failed <- err
+				return
+			}
+			log.Printf("Provider %s authorized\n", name)
+		}()
 
-		http.ServeContent(w, r, img.Key, time.Time{}, bytes.NewReader(img.Data))
-	})
+		select {
+		case auth := <-prompt:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(auth)
+		case err := <-failed:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+	}))
+
+	if uploads != nil {
+		http.HandleFunc("/upload", auth.require(roleUploader, uploads.handle))
+		// the QR code carries the upload token, and is shown on the frame for anyone in the room to scan
+		http.HandleFunc("/upload/qr.png", auth.require(roleViewer, uploads.qrCode))
+	}
+
+	http.HandleFunc("/metrics", auth.require(roleAdmin, promhttp.Handler().ServeHTTP))
+	// health checks are left open for load balancers and supervisors
+	http.HandleFunc("/healthz", healthCheck(healthy))
+	http.HandleFunc("/readyz", healthCheck(ready))
+
+	server := &http.Server{Addr: ":" + port, Handler: instrument(http.DefaultServeMux)}
+	server.TLSConfig, err = serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	go expireSessions()
 
 	log.Printf("Go Photo Frame is running on port %s\n", port)
-	return http.ListenAndServe(":"+port, nil)
+	if server.TLSConfig == nil {
+		return server.ListenAndServe()
+	}
+	// certificates come from the tls config, and http/2 is enabled automatically over tls
+	return server.ListenAndServeTLS("", "")
+}
+
+// imageUpdate handles POSTs which change the metadata of the image passed in the key parameter
+func imageUpdate(update func(r *http.Request, img *image)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		err := updateImage(r.FormValue("key"), func(img *image) {
+			update(r, img)
+		})
+		if err == bh.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating image: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
@@ -0,0 +1,298 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	bh "github.com/timshannon/bolthold"
+)
+
+const (
+	sessionCookie      = "session"
+	sessionHistorySize = 100
+	sessionExpiration  = 10 * time.Minute
+	sessionActive      = time.Minute // sessions seen within this are controlled when no session is specified
+)
+
+// playback commands sent to a display
+const (
+	commandNext     = "next"
+	commandPrevious = "previous"
+	commandPause    = "pause"
+	commandResume   = "resume"
+)
+
+// session is a single display's playback history and state
+type session struct {
+	sync.Mutex
+	id       string
+	history  [][]string // keys of the images shown together on each slide
+	position int
+	paused   bool
+	event    string // the event of the last slide shown, for introducing the next one in story order
+	lastSeen time.Time
+	commands chan string
+}
+
+var sessions = struct {
+	sync.Mutex
+	all map[string]*session
+}{
+	all: make(map[string]*session),
+}
+
+// getSession returns the display's session from its cookie, starting a new one if needed
+func getSession(w http.ResponseWriter, r *http.Request) (*session, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if s, ok := sessions.all[cookie.Value]; ok {
+			return s, nil
+		}
+	}
+
+	removeExpiredSessions()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		id:       fmt.Sprintf("%x", id),
+		position: -1,
+		lastSeen: time.Now(),
+		commands: make(chan string, 10),
+	}
+	sessions.all[s.id] = s
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+	return s, nil
+}
+
+// removeExpiredSessions forgets the sessions of displays which haven't been seen for a while, and their
+// metrics.  The sessions lock must be held
+func removeExpiredSessions() {
+	for id, s := range sessions.all {
+		s.Lock()
+		if time.Since(s.lastSeen) > sessionExpiration {
+			delete(sessions.all, id)
+			imagesServed.DeleteLabelValues(sessionLabel(id))
+		}
+		s.Unlock()
+	}
+}
+
+// expireSessions removes expired sessions as they expire, rather than only when a new session starts
+func expireSessions() {
+	for range time.Tick(sessionExpiration) {
+		sessions.Lock()
+		removeExpiredSessions()
+		sessions.Unlock()
+	}
+}
+
+// sessionStatus is what a remote control sees of a display's session
+type sessionStatus struct {
+	Session string   `json:"session"`
+	Key     string   `json:"key"`
+	Keys    []string `json:"keys"` // every image on the slide, when more than one is shown
+	Paused  bool     `json:"paused"`
+}
+
+func (s *session) status() sessionStatus {
+	s.Lock()
+	defer s.Unlock()
+	status := sessionStatus{Session: s.id, Paused: s.paused}
+	if s.position >= 0 && s.position < len(s.history) {
+		status.Keys = s.history[s.position]
+		status.Key = status.Keys[0]
+	}
+	return status
+}
+
+// controlledSessions returns the passed in session, or every active session if id is empty
+func controlledSessions(id string) []*session {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if id != "" {
+		if s, ok := sessions.all[id]; ok {
+			return []*session{s}
+		}
+		return nil
+	}
+
+	var active []*session
+	for _, s := range sessions.all {
+		s.Lock()
+		if time.Since(s.lastSeen) < sessionActive {
+			active = append(active, s)
+		}
+		s.Unlock()
+	}
+	return active
+}
+
+// next moves forward through the session's history, and once at the end of it, on to the next
+// slide in the queue for a display with the passed in orientation
+func (s *session) next(q *queue, display string) ([]*image, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSeen = time.Now()
+
+	for s.position < len(s.history)-1 {
+		s.position++
+		slide, err := s.current()
+		if err != nil || slide != nil {
+			return slide, err
+		}
+	}
+
+	slide, err := q.nextSlide(display)
+	if err != nil || slide == nil {
+		return slide, err
+	}
+
+	keys := make([]string, len(slide))
+	for i := range slide {
+		keys[i] = slide[i].Key
+	}
+	s.history = append(s.history, keys)
+	if len(s.history) > sessionHistorySize {
+		s.history = s.history[len(s.history)-sessionHistorySize:]
+	}
+	s.position = len(s.history) - 1
+	return slide, nil
+}
+
+// previous moves back through the session's history, showing the oldest image again once it's
+// reached
+func (s *session) previous(q *queue, display string) ([]*image, error) {
+	s.Lock()
+	start := s.position - 1
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i >= 0 && i < len(s.history); i-- {
+		s.position = i
+		slide, err := s.current()
+		if err != nil || slide != nil {
+			s.lastSeen = time.Now()
+			s.Unlock()
+			return slide, err
+		}
+	}
+	s.Unlock()
+
+	// nothing left in the history to go back to
+	return s.next(q, display)
+}
+
+// current returns the slide at the current history position, leaving out images that have since been
+// deleted or hidden, and removing the slide from the history and returning nil if none are left.
+// The session must be locked
+func (s *session) current() ([]*image, error) {
+	var slide []*image
+	for _, key := range s.history[s.position] {
+		img, err := getImage(key)
+		if err == bh.ErrNotFound || (err == nil && img.Hidden) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		slide = append(slide, img)
+	}
+	if len(slide) == 0 {
+		s.history = append(s.history[:s.position], s.history[s.position+1:]...)
+		s.position--
+		return nil, nil
+	}
+	return slide, nil
+}
+
+// startsEvent records the event of the slide being shown, returning whether it's a different event to
+// the last slide's
+func (s *session) startsEvent(event string) bool {
+	s.Lock()
+	defer s.Unlock()
+	starts := event != "" && event != s.event
+	s.event = event
+	return starts
+}
+
+func (s *session) isPaused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.paused
+}
+
+// send passes a command on to the session's display, pause and resume are also kept as state so
+// they apply to the next page the display loads
+func (s *session) send(command string) {
+	s.Lock()
+	switch command {
+	case commandPause:
+		s.paused = true
+	case commandResume:
+		s.paused = false
+	}
+	s.Unlock()
+
+	select {
+	case s.commands <- command:
+	default:
+		// display isn't listening
+	}
+}
+
+// listen streams commands to the display as server-sent events until the display disconnects
+func (s *session) listen(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// commands sent before this page was loaded no longer apply
+	for len(s.commands) > 0 {
+		<-s.commands
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case command := <-s.commands:
+			fmt.Fprintf(w, "data: %s\n\n", command)
+		case <-keepAlive.C:
+			s.Lock()
+			s.lastSeen = time.Now()
+			s.Unlock()
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"go.etcd.io/bbolt"
+)
+
+// eviction policies, which decide the order images are removed in once storage is full
+const (
+	evictOldest      = "oldest"
+	evictLeastShown  = "leastShown"
+	evictLowestRated = "lowestRated"
+)
+
+// storageLimit is a provider's share of the storage budget
+type storageLimit struct {
+	quota    int64   // maximum bytes the provider can use, 0 for no limit
+	minShare float64 // fraction of the storage budget the provider keeps, even if other providers need room
+}
+
+var providerLimits = make(map[string]storageLimit)
+
+// shown records when an image was last displayed, it's kept separate from the image so that the
+// image data isn't rewritten every time it's shown
+type shown struct {
+	Key  string `boltholdKey:"Key"`
+	Last time.Time
+}
+
+func markShown(key string) error {
+	return store.Upsert(key, &shown{Key: key, Last: time.Now()})
+}
+
+// stored is what eviction needs to know about an image, it's kept separate from the image so that
+// deciding what to remove doesn't read the data of every image
+type stored struct {
+	Key      string `boltholdKey:"Key"`
+	Provider string
+	Date     time.Time
+	Size     int64
+	Variants int64 // the size of the image rendered for displays, which is part of the storage budget
+	Kept     bool  // pinned and favorite images are never evicted
+	Rating   int
+	Held     bool
+	Hidden   bool
+}
+
+// txSaveStored records what eviction needs to know about an image, whenever the image is saved
+func txSaveStored(tx *bbolt.Tx, img *image) error {
+	size := img.Size
+	if size == 0 {
+		size = int64(len(img.Data))
+	}
+	existing := &stored{}
+	err := store.TxGet(tx, img.Key, existing)
+	if err != nil && err != bh.ErrNotFound {
+		return err
+	}
+	return store.TxUpsert(tx, img.Key, &stored{
+		Key:      img.Key,
+		Provider: img.Provider,
+		Date:     img.Date,
+		Size:     size,
+		Variants: existing.Variants,
+		Kept:     img.Pinned || img.Favorite,
+		Rating:   img.Rating,
+		Held:     img.Held,
+		Hidden:   img.Hidden,
+	})
+}
+
+// recordStoredImages records what eviction needs to know about images stored before it was kept apart
+// from them.  It only reads the images if nothing has been recorded yet
+func recordStoredImages() error {
+	count, err := store.Count(&stored{}, nil)
+	if err != nil || count > 0 {
+		return err
+	}
+	return store.Bolt().Update(func(tx *bbolt.Tx) error {
+		return store.TxForEach(tx, nil, func(img *image) error {
+			return txSaveStored(tx, img)
+		})
+	})
+}
+
+// parseSize parses a byte size such as 500MB or 2GB, a plain number is in bytes
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			multiplier = unit.bytes
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// evict removes images until the store is under both the maximum image count and the storage
+// budget. Pinned and favorite images are never removed, providers over their quota are trimmed
+// first, and a provider's minimum share is only given up once every other image has been removed.
+// Images held for moderation are removed before any image being shown, and don't keep a share
+func evict(tx *bbolt.Tx) (err error) {
+	maxCount := viper.GetInt("maxImageCount")
+	maxSize, err := parseSize(viper.GetString("maxStorageSize"))
+	if err != nil {
+		return err
+	}
+
+	// hidden images are only a small record kept so they aren't imported again, and are never removed
+	var images []*stored
+	err = store.TxFind(tx, &images, bh.Where("Hidden").Eq(false))
+	if err != nil {
+		return err
+	}
+
+	count := len(images)
+	var size int64
+	usage := make(map[string]int64)
+	counts := make(map[string]int)
+	for _, img := range images {
+		// removing an image removes its variants too
+		img.Size += img.Variants
+		size += img.Size
+		usage[img.Provider] += img.Size
+		counts[img.Provider]++
+	}
+	defer func() {
+		if err == nil {
+			setStoreMetrics(counts, usage)
+		}
+	}()
+
+	overQuota := func(provider string) bool {
+		limit := providerLimits[provider]
+		return limit.quota > 0 && usage[provider] > limit.quota
+	}
+
+	overLimit := func() bool {
+		return (maxCount > 0 && count > maxCount) || (maxSize > 0 && size > maxSize)
+	}
+
+	needsEviction := overLimit()
+	for provider := range usage {
+		if overQuota(provider) {
+			needsEviction = true
+		}
+	}
+	if !needsEviction {
+		return nil
+	}
+
+	candidates := make([]*stored, 0, len(images))
+	for _, img := range images {
+		if !img.Kept {
+			candidates = append(candidates, img)
+		}
+	}
+
+	err = sortEvictionCandidates(tx, candidates)
+	if err != nil {
+		return err
+	}
+
+	remove := func(img *stored) error {
+		err := store.TxDelete(tx, img.Key, &image{})
+		if err != nil {
+			return err
+		}
+		for _, dataType := range []interface{}{&original{}, &shown{}, &stored{}} {
+			err = store.TxDelete(tx, img.Key, dataType)
+			if err != nil && err != bh.ErrNotFound {
+				return err
+			}
+		}
+		err = store.TxDeleteMatching(tx, &variant{}, bh.Where("Image").Eq(img.Key))
+		if err != nil {
+			return err
+		}
+		count--
+		size -= img.Size
+		usage[img.Provider] -= img.Size
+		counts[img.Provider]--
+		return nil
+	}
+
+	var remaining []*stored
+	for _, img := range candidates {
+		if overQuota(img.Provider) {
+			if err = remove(img); err != nil {
+				return err
+			}
+			continue
+		}
+		remaining = append(remaining, img)
+	}
+
+	candidates = remaining
+	remaining = nil
+	for _, img := range candidates {
+		if !overLimit() {
+			return nil
+		}
+		limit := providerLimits[img.Provider]
+		// held images don't keep a provider's share, so a flood from unknown senders can't push out
+		// images which are being shown
+		if maxSize > 0 && !img.Held && float64(usage[img.Provider]-img.Size) < limit.minShare*float64(maxSize) {
+			remaining = append(remaining, img)
+			continue
+		}
+		if err = remove(img); err != nil {
+			return err
+		}
+	}
+
+	// every provider is down to its minimum share, so the shares have to give
+	for _, img := range remaining {
+		if !overLimit() {
+			return nil
+		}
+		if err = remove(img); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortEvictionCandidates sorts images in the order they should be removed: images held for moderation,
+// then the rest in the order of the configured eviction policy, falling back to the oldest images first
+func sortEvictionCandidates(tx *bbolt.Tx, images []*stored) error {
+	err := sortByPolicy(tx, images)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Held && !images[j].Held
+	})
+	return nil
+}
+
+func sortByPolicy(tx *bbolt.Tx, images []*stored) error {
+	oldest := func(i, j int) bool { return images[i].Date.Before(images[j].Date) }
+
+	switch viper.GetString("evictionPolicy") {
+	case evictLeastShown:
+		var records []*shown
+		err := store.TxFind(tx, &records, nil)
+		if err != nil {
+			return err
+		}
+		last := make(map[string]time.Time, len(records))
+		for _, r := range records {
+			last[r.Key] = r.Last
+		}
+		sort.SliceStable(images, func(i, j int) bool {
+			iLast, iShown := last[images[i].Key]
+			jLast, jShown := last[images[j].Key]
+			if iShown != jShown {
+				// images which haven't been shown yet, like ones just added, are kept the longest
+				return iShown
+			}
+			if !iLast.Equal(jLast) {
+				return iLast.Before(jLast)
+			}
+			return oldest(i, j)
+		})
+	case evictLowestRated:
+		rating := func(img *stored) int {
+			if img.Rating == 0 {
+				return viper.GetInt("unratedRating")
+			}
+			return img.Rating
+		}
+		sort.SliceStable(images, func(i, j int) bool {
+			if rating(images[i]) != rating(images[j]) {
+				return rating(images[i]) < rating(images[j])
+			}
+			return oldest(i, j)
+		})
+	default:
+		sort.SliceStable(images, oldest)
+	}
+	return nil
+}
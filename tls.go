@@ -0,0 +1,175 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tls modes
+const (
+	tlsOff        = ""
+	tlsFiles      = "files"
+	tlsSelfSigned = "selfsigned"
+	tlsACME       = "acme"
+)
+
+const selfSignedDuration = 10 * 365 * 24 * time.Hour
+
+// serverTLSConfig returns the tls config for the configured tls mode, or nil if the server should
+// run over plain http
+func serverTLSConfig() (*tls.Config, error) {
+	switch viper.GetString("tls.mode") {
+	case tlsOff:
+		return nil, nil
+	case tlsFiles:
+		cert, err := tls.LoadX509KeyPair(viper.GetString("tls.certFile"), viper.GetString("tls.keyFile"))
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case tlsSelfSigned:
+		cert, err := selfSignedCertificate(filepath.Dir(viper.GetString("dataFile")))
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case tlsACME:
+		return acmeTLSConfig()
+	}
+	return nil, fmt.Errorf("Invalid tls mode %s", viper.GetString("tls.mode"))
+}
+
+// selfSignedCertificate loads the certificate generated on a previous run from dir, generating and
+// saving a new one if there isn't one yet, so browsers only need to trust it once
+func selfSignedCertificate(dir string) (tls.Certificate, error) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return cert, nil
+	}
+	if !os.IsNotExist(err) {
+		return tls.Certificate{}, err
+	}
+
+	log.Printf("Generating self-signed certificate %s\n", certFile)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Go Photo Frame"}, CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedDuration),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// acmeTLSConfig gets certificates from an ACME server such as Let's Encrypt, answering challenges
+// over TLS-ALPN on the server's port, and over http if httpPort is set
+func acmeTLSConfig() (*tls.Config, error) {
+	domains := viper.GetStringSlice("tls.acme.domains")
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("At least one domain is required for ACME")
+	}
+
+	client := &acme.Client{DirectoryURL: viper.GetString("tls.acme.directoryURL")}
+	if caFile := viper.GetString("tls.acme.caFile"); caFile != "" {
+		// for ACME servers with a private CA, like a local Pebble test server
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(filepath.Join(filepath.Dir(viper.GetString("dataFile")), "acme")),
+		Email:      viper.GetString("tls.acme.email"),
+		Client:     client,
+	}
+
+	if httpPort := viper.GetString("tls.acme.httpPort"); httpPort != "" {
+		go func() {
+			// answers http-01 challenges and redirects everything else to https
+			log.Printf("Error serving ACME http challenges: %s\n",
+				http.ListenAndServe(":"+httpPort, m.HTTPHandler(nil)))
+		}()
+	}
+
+	return m.TLSConfig(), nil
+}
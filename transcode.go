@@ -0,0 +1,346 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	goimage "image"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	goexiftiff "github.com/rwcarlsen/goexif/tiff"
+	"github.com/spf13/viper"
+	bh "github.com/timshannon/bolthold"
+	"golang.org/x/image/tiff"
+)
+
+const transcodeQuality = 90
+
+// keptEXIF are the EXIF fields copied into transcoded images, by the IFD they're stored in, which are
+// what browsers and the frame read from them
+var keptEXIF = struct {
+	ifd0, exif, gps []exif.FieldName
+}{
+	ifd0: []exif.FieldName{exif.Make, exif.Model, exif.Orientation, exif.DateTime},
+	exif: []exif.FieldName{exif.DateTimeOriginal, exif.DateTimeDigitized},
+	gps: []exif.FieldName{exif.GPSVersionID, exif.GPSLatitudeRef, exif.GPSLatitude, exif.GPSLongitudeRef,
+		exif.GPSLongitude, exif.GPSAltitudeRef, exif.GPSAltitude, exif.GPSTimeStamp, exif.GPSDateStamp},
+}
+
+// tiff tags pointing to the EXIF and GPS IFDs
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+)
+
+// transcoders convert images browsers can't display to jpeg, keyed by content type
+var transcoders = map[string]func(data []byte) ([]byte, error){
+	"image/heic":            transcodeHEIF,
+	"image/heif":            transcodeHEIF,
+	"image/tiff":            transcodeTIFF,
+	"image/x-adobe-dng":     transcodeRawPreview,
+	"image/x-canon-cr2":     transcodeRawPreview,
+	"image/x-nikon-nef":     transcodeRawPreview,
+	"image/x-sony-arw":      transcodeRawPreview,
+	"image/x-olympus-orf":   transcodeRawPreview,
+	"image/x-panasonic-rw2": transcodeRawPreview,
+}
+
+// original is the untouched data of a transcoded image, so that none of its metadata is lost
+type original struct {
+	Key         string `boltholdKey:"Key"`
+	ContentType string
+	Data        []byte
+}
+
+// transcode replaces the image's data with a jpeg if the browser can't display its content type,
+// and returns the original data, or nil if the image didn't need transcoding
+func transcode(img *image) (*original, error) {
+	t, ok := transcoders[img.ContentType]
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := t(img.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	orig := &original{
+		Key:         img.Key,
+		ContentType: img.ContentType,
+		Data:        img.Data,
+	}
+	img.Data = data
+	img.ContentType = "image/jpeg"
+	return orig, nil
+}
+
+// transcodeStoredImages transcodes any images stored before they were transcoded at ingest
+func transcodeStoredImages() {
+	types := make([]interface{}, 0, len(transcoders))
+	for ctype := range transcoders {
+		types = append(types, ctype)
+	}
+
+	keys, err := imageKeys(bh.Where("ContentType").In(types...))
+	if err != nil {
+		log.Printf("Error finding images to transcode: %s\n", err)
+		return
+	}
+
+	for _, key := range keys {
+		img, err := getImage(key)
+		if err != nil {
+			log.Printf("Error getting %s to transcode: %s\n", key, err)
+			continue
+		}
+		orig, err := transcode(img)
+		if err != nil {
+			log.Printf("Error transcoding %s from %s: %s\n", img.Key, img.ContentType, err)
+			continue
+		}
+		err = store.Upsert(orig.Key, orig)
+		if err != nil {
+			log.Printf("Error storing original of %s: %s\n", img.Key, err)
+			continue
+		}
+		img.Size = int64(len(img.Data) + len(orig.Data))
+		err = saveImage(img)
+		if err != nil {
+			log.Printf("Error storing transcoded image %s: %s\n", img.Key, err)
+		}
+	}
+}
+
+func encodeJPEG(img goimage.Image) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: transcodeQuality})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func transcodeTIFF(data []byte) ([]byte, error) {
+	img, err := tiff.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	jpg, err := encodeJPEG(img)
+	if err != nil {
+		return nil, err
+	}
+	return withEXIF(jpg, data), nil
+}
+
+// transcodeRawPreview uses the largest jpeg preview embedded in a camera raw file, which every
+// common raw format includes, rather than developing the raw sensor data
+func transcodeRawPreview(data []byte) ([]byte, error) {
+	soi := []byte{0xFF, 0xD8, 0xFF}
+	largest := -1
+	largestSize := 0
+
+	for offset := 0; ; offset++ {
+		i := bytes.Index(data[offset:], soi)
+		if i == -1 {
+			break
+		}
+		offset += i
+		// lossless jpegs used for the raw data itself aren't supported and are skipped here
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data[offset:]))
+		if err == nil && cfg.Width*cfg.Height > largestSize {
+			largest = offset
+			largestSize = cfg.Width * cfg.Height
+		}
+	}
+
+	if largest == -1 {
+		return nil, fmt.Errorf("No jpeg preview found in raw image")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data[largest:]))
+	if err != nil {
+		return nil, err
+	}
+	jpg, err := encodeJPEG(img)
+	if err != nil {
+		return nil, err
+	}
+	// the preview's own EXIF data, if it has any, often leaves out the orientation of the photo
+	return withEXIF(jpg, data), nil
+}
+
+// withEXIF adds the orientation, date and location of a TIFF based image, which camera raw files are,
+// to a jpeg transcoded from it, since they're lost when it's encoded
+func withEXIF(jpg, data []byte) []byte {
+	segment := exifSegment(data)
+	if segment == nil || len(jpg) < 2 {
+		return jpg
+	}
+	out := make([]byte, 0, len(jpg)+len(segment))
+	out = append(out, jpg[:2]...) // start of image
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+// exifEntry is a tag in a tiff IFD, its value in the byte order of the tiff
+type exifEntry struct {
+	id    uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifSegment returns a jpeg APP1 segment with the kept EXIF fields of a TIFF based image, or nil if
+// it doesn't have any
+func exifSegment(data []byte) []byte {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bytes.HasPrefix(data, []byte("MM")) {
+		order = binary.BigEndian
+	}
+
+	entries := func(names []exif.FieldName) []exifEntry {
+		var e []exifEntry
+		for _, name := range names {
+			tag, err := x.Get(name)
+			if err != nil {
+				continue
+			}
+			e = append(e, exifEntry{id: tag.Id, typ: uint16(tag.Type), count: tag.Count, value: tag.Val})
+		}
+		return e
+	}
+	pointer := func(id uint16, offset int) exifEntry {
+		value := make([]byte, 4)
+		order.PutUint32(value, uint32(offset))
+		return exifEntry{id: id, typ: uint16(goexiftiff.DTLong), count: 1, value: value}
+	}
+
+	ifd0, exifIFD, gps := entries(keptEXIF.ifd0), entries(keptEXIF.exif), entries(keptEXIF.gps)
+	if len(ifd0)+len(exifIFD)+len(gps) == 0 {
+		return nil
+	}
+	// the pointers are the last tags in IFD0, as tags are in order
+	pointers := 0
+	if len(exifIFD) > 0 {
+		pointers++
+	}
+	if len(gps) > 0 {
+		pointers++
+	}
+	offset := 8 + ifdLength(len(ifd0)+pointers, ifd0)
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, pointer(exifIFDPointer, offset))
+		offset += ifdLength(len(exifIFD), exifIFD)
+	}
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, pointer(gpsIFDPointer, offset))
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(data[:4]) // byte order and magic number
+	binary.Write(buf, order, uint32(8))
+	for _, ifd := range [][]exifEntry{ifd0, exifIFD, gps} {
+		if len(ifd) > 0 {
+			writeIFD(buf, order, ifd)
+		}
+	}
+
+	// the segment length includes itself and the Exif header
+	length := 2 + 6 + buf.Len()
+	if length > 0xFFFF {
+		return nil
+	}
+	segment := []byte{0xFF, 0xE1, byte(length >> 8), byte(length)}
+	segment = append(segment, "Exif\x00\x00"...)
+	return append(segment, buf.Bytes()...)
+}
+
+// ifdLength returns the length of a tiff IFD with count tags, including the values of entries which
+// don't fit in a tag
+func ifdLength(count int, entries []exifEntry) int {
+	length := 2 + 12*count + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			length += len(e.value) + len(e.value)%2
+		}
+	}
+	return length
+}
+
+// writeIFD writes a tiff IFD at the end of buf, which holds the tiff from its start, followed by the
+// values which don't fit in its tags
+func writeIFD(buf *bytes.Buffer, order binary.ByteOrder, entries []exifEntry) {
+	offset := buf.Len() + 2 + 12*len(entries) + 4
+	var values []byte
+	binary.Write(buf, order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, order, e.id)
+		binary.Write(buf, order, e.typ)
+		binary.Write(buf, order, e.count)
+		if len(e.value) <= 4 {
+			buf.Write(e.value)
+			buf.Write(make([]byte, 4-len(e.value)))
+			continue
+		}
+		binary.Write(buf, order, uint32(offset+len(values)))
+		values = append(values, e.value...)
+		if len(e.value)%2 == 1 {
+			// values start on a word boundary
+			values = append(values, 0)
+		}
+	}
+	binary.Write(buf, order, uint32(0)) // there's no next IFD
+	buf.Write(values)
+}
+
+// transcodeHEIF runs the configured external command, since there is no native go HEVC decoder
+func transcodeHEIF(data []byte) ([]byte, error) {
+	return transcodeCommand(viper.GetStringSlice("heifCommand"), ".heic", data)
+}
+
+// transcodeCommand runs a command which converts the {input} file to a jpeg {output} file
+func transcodeCommand(command []string, ext string, data []byte) ([]byte, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("No transcode command configured")
+	}
+
+	dir, err := ioutil.TempDir("", "go-photo-frame")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input"+ext)
+	output := filepath.Join(dir, "output.jpg")
+	err = ioutil.WriteFile(input, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, len(command))
+	for i := range command {
+		args[i] = strings.NewReplacer("{input}", input, "{output}", output).Replace(command[i])
+	}
+
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Error running %s: %s %s", args[0], err, out)
+	}
+
+	return ioutil.ReadFile(output)
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// transitions between images
+const (
+	transitionNone      = "none"
+	transitionCrossfade = "crossfade"
+	transitionSlide     = "slide"
+	transitionZoom      = "zoom"
+	transitionKenBurns  = "kenburns" // crossfade, then a slow pan and zoom for as long as the image is shown
+)
+
+const transitionCookie = "transition"
+
+func validTransition(name string) bool {
+	switch name {
+	case transitionNone, transitionCrossfade, transitionSlide, transitionZoom, transitionKenBurns:
+		return true
+	}
+	return false
+}
+
+// focalPoint is where in an image, as fractions of its width and height, pans and zooms are centered on
+type focalPoint struct {
+	X float64
+	Y float64
+}
+
+// transitionData is how a page transitions to its image
+type transitionData struct {
+	Transition         string // the animation used to bring the image in and the previous image out
+	TransitionDuration int64
+	KenBurns           bool
+	KenBurnsDuration   int64
+	ZoomOut            bool
+}
+
+// frameTransition returns the transition for a frame, which can be chosen for each frame by opening
+// it once with the transition query parameter
+func frameTransition(w http.ResponseWriter, r *http.Request) string {
+	if name := r.URL.Query().Get("transition"); validTransition(name) {
+		http.SetCookie(w, &http.Cookie{
+			Name:    transitionCookie,
+			Value:   name,
+			Path:    "/",
+			Expires: time.Now().AddDate(10, 0, 0),
+		})
+		return name
+	}
+	if cookie, err := r.Cookie(transitionCookie); err == nil && validTransition(cookie.Value) {
+		return cookie.Value
+	}
+	return viper.GetString("transition")
+}
+
+// newTransitionData returns how to transition to a slide shown for imageDuration.  Transitions take
+// at most half of the time a slide is shown
+func newTransitionData(name string, video bool, imageDuration time.Duration) transitionData {
+	duration := viper.GetDuration("transitionDuration")
+	if duration > imageDuration/2 {
+		duration = imageDuration / 2
+	}
+
+	t := transitionData{
+		Transition:         name,
+		TransitionDuration: int64(duration / time.Millisecond),
+	}
+	if name == transitionKenBurns {
+		t.Transition = transitionCrossfade
+		// videos only crossfade
+		t.KenBurns = !video
+		t.KenBurnsDuration = int64((imageDuration + duration) / time.Millisecond)
+		t.ZoomOut = rand.Intn(2) == 0
+	}
+	return t
+}
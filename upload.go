@@ -0,0 +1,200 @@
+// Copyright 2019 Tim Shannon. All rights reserved.
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	bh "github.com/timshannon/bolthold"
+)
+
+const defaultMaxUploadSize = 20 * 1024 * 1024
+
+var errAlreadyAdded = errors.New("Already added")
+
+// upload is a provider for images uploaded through the server, so it never has anything to poll
+type upload struct {
+	maxSize int64
+	qrToken string // API token included in the QR code, so guests can upload without logging in
+}
+
+type uploadResult struct {
+	File  string `json:"file"`
+	Error string `json:"error,omitempty"`
+}
+
+var uploadTemplate = template.Must(template.New("").Parse(uploadPage))
+
+type uploadConfig struct {
+	MaxSize string `config:"maxSize"`
+	QRToken secret `config:"qrToken"`
+}
+
+func (u *upload) initialize(config *configSection) error {
+	settings := uploadConfig{}
+	if err := config.decode(&settings); err != nil {
+		return err
+	}
+
+	u.maxSize = defaultMaxUploadSize
+	if settings.MaxSize != "" {
+		size, err := parseSize(settings.MaxSize)
+		if err != nil {
+			return config.errorf("maxSize", "%s", err)
+		}
+		u.maxSize = size
+	}
+	u.qrToken = string(settings.QRToken)
+	return nil
+}
+
+func (u *upload) name() string { return "upload" }
+
+// getImages has nothing to poll, uploaded images are added as they are received
+func (u *upload) getImages(lastImage *image) ([]*image, error) { return nil, nil }
+
+// handle serves the upload page, and receives the images posted from it
+func (u *upload) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		uploadTemplate.Execute(w, nil)
+	case "POST":
+		u.receive(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (u *upload) receive(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := requestIdentity(r)
+	var results []uploadResult
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		result := uploadResult{File: part.FileName()}
+		img, err := u.receiveFile(part, id)
+		if err != nil {
+			result.Error = err.Error()
+		} else if err = addImages([]*image{img}); err != nil {
+			log.Printf("Error adding uploaded image %s: %s\n", img.Key, err)
+			result.Error = "Error storing image"
+		} else {
+			imagesFetched.WithLabelValues(u.name()).Inc()
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// receiveFile validates an uploaded file, and returns it as an image
+func (u *upload) receiveFile(part *multipart.Part, id *identity) (*image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(part, u.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > u.maxSize {
+		return nil, fmt.Errorf("File is larger than the maximum of %d MB", u.maxSize/1024/1024)
+	}
+
+	img, err := fileImage(u.name(), part.FileName(), data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// the provider stays upload, since storage quotas, shares and metrics are kept by provider, and
+	// who uploaded it is the sender
+	img.Sender = id.name
+	return img, nil
+}
+
+// fileImage returns an image for a file's data, keyed by its contents so the same file is only
+// added once.  The date is when the photo was taken if it's in the file, otherwise the passed in date
+func fileImage(provider, filename string, data []byte, date time.Time) (*image, error) {
+	// browsers send a generic content type for formats they don't know, like HEIC
+	ctype := mediaContentType(http.DetectContentType(data), filename)
+	if ctype == "" {
+		return nil, fmt.Errorf("Only images and videos can be added")
+	}
+
+	key := fmt.Sprintf("%s.%x", provider, sha256.Sum256(data))
+	_, err := getImage(key)
+	if err == nil {
+		return nil, errAlreadyAdded
+	}
+	if err != bh.ErrNotFound {
+		return nil, err
+	}
+
+	if taken, ok := exifDate(data); ok {
+		date = taken
+	}
+
+	return &image{
+		Key:         key,
+		Date:        date,
+		Data:        data,
+		Provider:    provider,
+		ContentType: ctype,
+	}, nil
+}
+
+// qrCode serves a QR code linking to the upload page
+func (u *upload) qrCode(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := fmt.Sprintf("%s://%s/upload", scheme, r.Host)
+	if u.qrToken != "" {
+		link += "?token=" + url.QueryEscape(u.qrToken)
+	}
+
+	png, err := qrcode.Encode(link, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// uploadProvider returns the upload provider if it's configured
+func uploadProvider() *upload {
+	for _, p := range providers {
+		if u, ok := p.(*upload); ok {
+			return u
+		}
+	}
+	return nil
+}